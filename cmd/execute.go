@@ -2,8 +2,11 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"wf-engine/fleet"
 	"wf-engine/global"
 	"wf-engine/workflow"
@@ -27,34 +30,172 @@ func runserver() {
 	}
 }
 
+// loadworkflow builds the graph from the definition in filename, or falls back to the default
+// graph that sends every freight to a spot of its own around (10, 10) when filename is empty.
+func loadworkflow(filename string) (workflow.Node, error) {
+	if filename != "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		defer f.Close()
+		return workflow.Load(f)
+	}
+
+	return defaultworkflow()
+}
+
+// defaultworkflow sends every freight to a spot of its own, so that robots do not block each other
+// at their targets when traffic is enabled.
+func defaultworkflow() (workflow.Node, error) {
+	R := workflow.NewRoot("root")
+	A := workflow.NewJob([]workflow.Node{R}, "sending freight1 to (8, 10)", "freight1", workflow.NavigateTo(8, 10))
+	B := workflow.NewJob([]workflow.Node{R}, "sending freight2 to (10, 10)", "freight2", workflow.NavigateTo(10, 10))
+	C := workflow.NewJob([]workflow.Node{R}, "sending freight3 to (12, 10)", "freight3", workflow.NavigateTo(12, 10))
+	D := workflow.NewConditional([]workflow.Node{A, B, C}, "are all robots at their targets?", nil)
+
+	workflow.NewTerminal([]workflow.Node{A, B, C}, "all robots have started moving")
+	workflow.NewTerminal([]workflow.Node{D}, "all robots have reached their targets")
+	E := workflow.NewTerminal([]workflow.Node{D}, "some robots have not reached their targets")
+	D.(*workflow.Conditional).Else(E)
+
+	return R, nil
+}
+
+// newengine returns an engine that checkpoints runs, with the default workflow registered as
+// "default" and the definition in filename, if any, registered under its file name.
+func newengine(filename string) (*workflow.Engine, string, error) {
+	engine := workflow.NewEngine(workflow.NewFileStore(viper.GetString("checkpoint.dir")))
+	if err := engine.Register("default", defaultworkflow); err != nil {
+		return nil, "", err
+	}
+
+	if filename == "" {
+		return engine, "default", nil
+	}
+
+	definition, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return engine, filename, engine.RegisterSource(filename, definition)
+}
+
 func runworkflow(cmd *cobra.Command, args []string) error {
 	if err := viper.ReadInConfig(); err != nil {
 		return err
 	}
 
+	filename, err := cmd.Flags().GetString("file")
+	if err != nil {
+		return err
+	}
+
+	engine, name, err := newengine(filename)
+	if err != nil {
+		return err
+	}
+
+	return execute(cmd, func(ctx context.Context) (*workflow.Instance, error) {
+		i, err := engine.Start(ctx, name)
+		if err == nil {
+			log.Infof("Starting run %s, resume it with: wf-engine resume %s", i.ID, i.ID)
+		}
+
+		return i, err
+	})
+}
+
+func resume(cmd *cobra.Command, args []string) error {
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+
+	// Checkpoints hold the definition of the run, so resuming it does not need --file.
+	engine, _, err := newengine("")
+	if err != nil {
+		return err
+	}
+
+	return execute(cmd, func(ctx context.Context) (*workflow.Instance, error) {
+		log.Infof("Resuming run %s", args[0])
+		return engine.Resume(ctx, args[0])
+	})
+}
+
+// execute starts the fleet server and global state, then starts a workflow instance and waits for
+// it to finish.
+func execute(cmd *cobra.Command, start func(ctx context.Context) (*workflow.Instance, error)) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	adapter, err := global.NewFleetAdapter()
+	if err != nil {
+		return err
+	}
+
+	global.UseFleet(adapter)
+
+	grid, err := fleet.LoadMap()
+	if err != nil {
+		return err
+	}
+
+	fleet.Default().SetGrid(grid)
+	fleet.Default().SetTraffic(fleet.LoadTraffic())
+	fleet.Default().SetMissionRetention(viper.GetDuration("robot.mission_retention"))
+	if err := fleet.Default().SetFaults(fleet.LoadFaults()); err != nil {
+		return err
+	}
+
 	// Make sure global state can poll robots correctly before starting workflow
 	done := make(chan struct{})
 	go runserver()
 	go global.State.Activate(ctx, done)
 	<-done
 
-	R := workflow.NewRoot("root")
-	A := workflow.NewJob([]workflow.Node{R}, "sending freight1 to (10, 10)", "freight1")
-	B := workflow.NewJob([]workflow.Node{R}, "sending freight2 to (10, 10)", "freight2")
-	C := workflow.NewJob([]workflow.Node{R}, "sending freight3 to (10, 10)", "freight3")
-	D := workflow.NewConditional([]workflow.Node{A, B, C}, "are all robots at (10, 10)?")
-
-	workflow.NewTerminal([]workflow.Node{A, B, C}, "all robots have started moving")
-	workflow.NewTerminal([]workflow.Node{D}, "all robots have reached (10, 10)")
+	// Interrupting the program cancels the run, which stops every robot that a job is still waiting
+	// for. Robots sent by jobs that do not wait for them carry on with their missions.
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Info("Cancelling workflow")
+			stop()
+		case <-runCtx.Done():
+		}
+	}()
 
-	err := workflow.Run(R)
+	i, err := start(runCtx)
 	if err != nil {
 		return err
 	}
 
+	result, err := i.Wait()
+	if result != nil {
+		log.Info(result)
+	}
+
+	if filename, _ := cmd.Flags().GetString("export"); filename != "" {
+		if err := workflow.Export(i.Root, filename); err != nil {
+			log.Error(err)
+		}
+	}
+
+	var runErr *workflow.RunError
+	if errors.As(err, &runErr) && !runErr.Fatal() {
+		log.Warn(err)
+	} else if err != nil {
+		return err
+	}
+
 	log.Info("Graph is completed")
 
 	var input string
@@ -79,11 +220,31 @@ func Execute() {
 	workflow := &cobra.Command{
 		Use:     "runworkflow",
 		Short:   "Run workflow",
-		Example: "wf-engine runworkflow",
+		Example: "wf-engine runworkflow --file conf/workflow.yaml",
 		RunE:    runworkflow,
 	}
+	workflow.Flags().StringP("file", "f", "", "YAML or JSON workflow definition")
+	workflow.Flags().String("export", "", "write the graph colored by execution state to this file, .mmd for Mermaid and DOT otherwise")
+
+	graph := &cobra.Command{
+		Use:     "graph",
+		Short:   "Print execution graph",
+		Example: "wf-engine graph --file conf/workflow.yaml --format mermaid",
+		RunE:    graph,
+	}
+	graph.Flags().StringP("file", "f", "", "YAML or JSON workflow definition")
+	graph.Flags().String("format", "dot", "output format, dot or mermaid")
+
+	resume := &cobra.Command{
+		Use:     "resume <run-id>",
+		Short:   "Resume an interrupted run from its checkpoint",
+		Example: "wf-engine resume 6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+		Args:    cobra.ExactArgs(1),
+		RunE:    resume,
+	}
+	resume.Flags().String("export", "", "write the graph colored by execution state to this file, .mmd for Mermaid and DOT otherwise")
 
-	root.AddCommand(workflow)
+	root.AddCommand(workflow, graph, resume)
 	if err := root.Execute(); err != nil {
 		log.Fatal(err)
 		os.Exit(1)
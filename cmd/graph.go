@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+	"wf-engine/workflow"
+
+	"github.com/spf13/cobra"
+)
+
+func graph(cmd *cobra.Command, args []string) error {
+	filename, err := cmd.Flags().GetString("file")
+	if err != nil {
+		return err
+	}
+
+	R, err := loadworkflow(filename)
+	if err != nil {
+		return err
+	}
+
+	format, _ := cmd.Flags().GetString("format")
+	switch format {
+	case "dot":
+		fmt.Print(workflow.DOT(R, false))
+	case "mermaid":
+		fmt.Print(workflow.Mermaid(R, false))
+	default:
+		return fmt.Errorf("unknown graph format %q, expected dot or mermaid", format)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package fleet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// StatusCharging is the status of a robot that charges at a dock.
+const StatusCharging = "CHARGING"
+
+// ErrBatteryEmpty is returned when a robot cannot be sent anywhere, because its battery is empty.
+var ErrBatteryEmpty = errors.New("battery is empty")
+
+// ErrNoDock is returned when a robot cannot be sent to charge, because the map has no dock.
+var ErrNoDock = errors.New("map has no charging dock")
+
+// settle takes the battery that r has used up while idle since it was last settled. Robots use
+// battery.idle_drain percent of their battery per second whatever they do, on top of what they
+// use to move. It must be called with the mutex held.
+func (s *Store) settle(r *Robot) {
+	now := time.Now()
+	if last, ok := s.settled[r.Name]; ok {
+		r.Battery = clampBattery(r.Battery - viper.GetFloat64("battery.idle_drain")*now.Sub(last).Seconds())
+	}
+
+	s.settled[r.Name] = now
+}
+
+func clampBattery(level float64) float64 {
+	return math.Max(0, math.Min(100, level))
+}
+
+// Charge starts a mission that takes a robot to a dock of the map, where it charges until its
+// battery is full. The nearest dock is picked when dock is empty. policy applies as in Send.
+func (s *Store) Charge(name, dock string, policy OverlapPolicy) (*Mission, error) {
+	policy, err := overlapPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dispatch(name, policy, func(r *Robot) (Pose, string, error) {
+		if s.grid == nil || len(s.grid.Docks) == 0 {
+			return Pose{}, "", fmt.Errorf("cannot send robot %s to charge: %w", name, ErrNoDock)
+		}
+
+		dock := dock
+		if dock == "" {
+			dock = s.nearestDock(r.CurrentPose)
+		}
+
+		pose, ok := s.grid.Docks[dock]
+		if !ok {
+			return Pose{}, "", fmt.Errorf("cannot send robot %s to charge: dock %s does not exist", name, dock)
+		}
+
+		return pose, dock, nil
+	})
+}
+
+// PlaceRobot puts a robot IDLE at pose with its battery at battery percent, as if it had been
+// carried there and its battery swapped. Its mission is cancelled, if it has one. It is how a robot
+// whose battery ran out gets going again, since it cannot even be sent to charge.
+func (s *Store) PlaceRobot(name string, pose Pose, battery float64) error {
+	if battery < 0 || battery > 100 {
+		return fmt.Errorf("battery must be between 0 and 100, got %v", battery)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.robots[name]
+	if !ok {
+		return fmt.Errorf("robot %s does not exist", name)
+	}
+
+	if m, ok := s.active[name]; ok {
+		m.end(MissionCancelled)
+		delete(s.active, name)
+	}
+
+	s.settle(r)
+	r.Battery = battery
+	r.CurrentPose = pose
+	r.Status = "IDLE"
+	r.TargetPose = nil
+	r.BlockedBy = ""
+	s.publish(r)
+	return nil
+}
+
+// newPlaceRobotHandler puts a robot at the pose and battery level in the body, see
+// Store.PlaceRobot.
+func newPlaceRobotHandler(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		req := struct {
+			Pose    Pose    `json:"pose"`
+			Battery float64 `json:"battery"`
+		}{Battery: 100}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		name := mux.Vars(r)["robot"]
+		if err := s.PlaceRobot(name, req.Pose, req.Battery); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		writeJSON(w, s.GetRobot(name))
+	}
+}
+
+// nearestDock returns the dock of the map that is closest to p in a straight line. It must be
+// called with the mutex held, and with docks on the map.
+func (s *Store) nearestDock(p Pose) string {
+	names := make([]string, 0, len(s.grid.Docks))
+	for name := range s.grid.Docks {
+		names = append(names, name)
+	}
+
+	distance := func(name string) float64 {
+		dock := s.grid.Docks[name]
+		return math.Hypot(dock.X-p.X, dock.Y-p.Y)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if di, dj := distance(names[i]), distance(names[j]); di != dj {
+			return di < dj
+		}
+
+		return names[i] < names[j]
+	})
+
+	return names[0]
+}
+
+// charge charges the robot of m for interval at battery.charge_rate percent per second, and
+// completes m once the battery is full. It reports whether m goes on. It must be called with the
+// mutex held.
+func (s *Store) charge(m *mission, r *Robot, interval time.Duration) bool {
+	r.Battery = clampBattery(r.Battery + viper.GetFloat64("battery.charge_rate")*interval.Seconds())
+	if r.Battery >= 100 {
+		s.finish(m, r, MissionCompleted)
+		return false
+	}
+
+	r.Status = StatusCharging
+	s.publish(r)
+	return true
+}
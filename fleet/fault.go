@@ -0,0 +1,402 @@
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// StatusError is the status of a robot that broke down, until it is sent on another mission.
+const StatusError = "ERROR"
+
+// ErrRobotOffline is returned when a robot cannot be sent anywhere, because it is offline.
+var ErrRobotOffline = errors.New("robot is offline")
+
+// Faults make the mock fleet server misbehave, so that failure handling can be tested. Every kind
+// of random fault is drawn from its own source derived from Seed, one per robot for the faults of
+// robots, so that a robot sees the same faults from one test to the next whatever the other robots
+// do. Requests draw their faults in the order they arrive.
+type Faults struct {
+	// Seed seeds the random faults, the current time is used when it is zero.
+	Seed int64 `json:"seed"`
+
+	// ErrorRate is the probability that a request to the API fails with a random 5xx status.
+	ErrorRate float64 `json:"error_rate"`
+
+	// Latency is added to every request to the API, along with a random part of up to Jitter.
+	Latency Duration `json:"latency"`
+	Jitter  Duration `json:"jitter"`
+
+	// StuckRate is the probability that a moving robot gets stuck at every step. It stays WORKING
+	// where it is until its mission is cancelled or preempted.
+	StuckRate float64 `json:"stuck_rate"`
+
+	// ErrorStatusRate is the probability that a moving robot breaks down at every step. Its
+	// mission fails, and it is ERROR until it is sent on another mission.
+	ErrorStatusRate float64 `json:"error_status_rate"`
+
+	// DropRate is the probability that a change to a robot is never streamed.
+	DropRate float64 `json:"drop_rate"`
+
+	// OfflineRate is the probability that a robot goes offline every second, for OfflineFor.
+	// Offline robots carry on with their mission, but they are left out of robot lists and
+	// streams, and cannot be sent anywhere.
+	OfflineRate float64  `json:"offline_rate"`
+	OfflineFor  Duration `json:"offline_for"`
+
+	// Offline robots stay offline until faults change.
+	Offline []string `json:"offline"`
+}
+
+// Duration is a time.Duration that reads and writes as a string like "250ms" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"250ms\": %v", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (f Faults) validate() error {
+	rates := map[string]float64{
+		"error_rate":        f.ErrorRate,
+		"stuck_rate":        f.StuckRate,
+		"error_status_rate": f.ErrorStatusRate,
+		"drop_rate":         f.DropRate,
+		"offline_rate":      f.OfflineRate,
+	}
+
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+
+	if f.Latency < 0 || f.Jitter < 0 || f.OfflineFor < 0 {
+		return errors.New("latency, jitter and offline_for cannot be negative")
+	}
+
+	if f.OfflineRate > 0 && f.OfflineFor == 0 {
+		return errors.New("offline_rate requires offline_for")
+	}
+
+	return nil
+}
+
+// LoadFaults returns the faults of the faults section in the config.
+func LoadFaults() Faults {
+	return Faults{
+		Seed:            viper.GetInt64("faults.seed"),
+		ErrorRate:       viper.GetFloat64("faults.error_rate"),
+		Latency:         Duration(viper.GetDuration("faults.latency")),
+		Jitter:          Duration(viper.GetDuration("faults.jitter")),
+		StuckRate:       viper.GetFloat64("faults.stuck_rate"),
+		ErrorStatusRate: viper.GetFloat64("faults.error_status_rate"),
+		DropRate:        viper.GetFloat64("faults.drop_rate"),
+		OfflineRate:     viper.GetFloat64("faults.offline_rate"),
+		OfflineFor:      Duration(viper.GetDuration("faults.offline_for")),
+		Offline:         viper.GetStringSlice("faults.offline"),
+	}
+}
+
+// SetFaults replaces the faults of the store with f, and reseeds random faults. Robots that were
+// offline are back online, unless f keeps them offline.
+func (s *Store) SetFaults(f Faults) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, name := range f.Offline {
+		if _, ok := s.robots[name]; !ok {
+			return fmt.Errorf("robot %s does not exist", name)
+		}
+	}
+
+	if s.stopFaults != nil {
+		s.stopFaults()
+		s.stopFaults = nil
+	}
+
+	seed := f.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	s.faults = f
+	s.seed = seed
+	s.sources = make(map[string]*rand.Rand)
+	s.generation++
+
+	offline := s.offline
+	s.offline = make(map[string]bool)
+	for _, name := range f.Offline {
+		s.disconnect(name, 0)
+	}
+
+	for name := range offline {
+		s.reconnect(name)
+	}
+
+	if f.OfflineRate > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopFaults = cancel
+		go s.disconnectRandomly(ctx, s.generation)
+	}
+
+	return nil
+}
+
+// Faults returns the faults of the store.
+func (s *Store) Faults() Faults {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f := s.faults
+	f.Offline = append([]string(nil), f.Offline...)
+	return f
+}
+
+// ClearFaults stops every fault, brings every robot back online, and puts robots that broke down
+// back to IDLE. Every robot is published, so that subscribers catch up with dropped changes.
+func (s *Store) ClearFaults() {
+	s.SetFaults(Faults{})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, r := range s.robots {
+		if r.Status == StatusError {
+			r.Status = "IDLE"
+		}
+
+		s.publish(r)
+	}
+}
+
+// Kinds of random faults, which each draw from their own sources.
+const (
+	requestFaults = "request"
+	stuckFaults   = "stuck"
+	errorFaults   = "error"
+	dropFaults    = "drop"
+	offlineFaults = "offline"
+)
+
+// source returns the source that the faults of kind draw from for robot, or for requests when
+// robot is empty. It is derived from the seed of the faults, kind and robot. It must be called
+// with the mutex held.
+func (s *Store) source(kind, robot string) *rand.Rand {
+	key := kind + "/" + robot
+	if r, ok := s.sources[key]; ok {
+		return r
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	r := rand.New(rand.NewSource(s.seed ^ int64(h.Sum64())))
+	s.sources[key] = r
+	return r
+}
+
+// chance reports whether a fault of kind that happens with probability p happens to robot, or to
+// a request when robot is empty. It must be called with the mutex held.
+func (s *Store) chance(kind, robot string, p float64) bool {
+	return p > 0 && s.source(kind, robot).Float64() < p
+}
+
+// requestFault returns the latency to add to a request to the API, and the 5xx status it fails
+// with, if it fails.
+func (s *Store) requestFault() (time.Duration, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delay := time.Duration(s.faults.Latency)
+	if s.faults.Jitter > 0 {
+		delay += time.Duration(s.source(requestFaults, "").Int63n(int64(s.faults.Jitter)))
+	}
+
+	if !s.chance(requestFaults, "", s.faults.ErrorRate) {
+		return delay, 0
+	}
+
+	statuses := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	return delay, statuses[s.source(requestFaults, "").Intn(len(statuses))]
+}
+
+// injectFaults delays requests to the API, and fails some of them, as the faults of s say.
+// Requests to /api/_faults/ and /api/_robots/ always go through.
+func (s *Store) injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/_faults/") || strings.HasPrefix(r.URL.Path, "/api/_robots/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		delay, status := s.requestFault()
+		if delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		if status != 0 {
+			w.WriteHeader(status)
+			w.Write([]byte("injected fault"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fail injects the faults of a robot that is about to move for m, where it breaks down or gets
+// stuck. A robot that is stuck may still break down. It reports whether m goes on, and whether a
+// fault was injected. It must be called with the mutex held.
+func (s *Store) fail(m *mission, r *Robot) (bool, bool) {
+	if s.chance(errorFaults, r.Name, s.faults.ErrorStatusRate) {
+		log.Warnf("robot %s broke down on mission %d", r.Name, m.ID)
+		m.end(MissionFailed)
+		delete(s.active, r.Name)
+
+		r.Status = StatusError
+		r.TargetPose = nil
+		r.BlockedBy = ""
+		s.publish(r)
+		return false, true
+	}
+
+	if !m.stuck && s.chance(stuckFaults, r.Name, s.faults.StuckRate) {
+		log.Warnf("robot %s got stuck on mission %d", r.Name, m.ID)
+		m.stuck = true
+	}
+
+	return m.stuck, m.stuck
+}
+
+// dropped reports whether a change to r is never streamed. It must be called with the mutex held.
+func (s *Store) dropped(r *Robot) bool {
+	return s.offline[r.Name] || s.chance(dropFaults, r.Name, s.faults.DropRate)
+}
+
+// disconnect takes a robot offline for d, or until faults change when d is zero. Subscribers are
+// cut off, so that they subscribe again and find the robot missing. It must be called with the
+// mutex held.
+func (s *Store) disconnect(name string, d time.Duration) {
+	log.Warnf("robot %s went offline", name)
+	s.offline[name] = true
+	for id, updates := range s.subscribers {
+		delete(s.subscribers, id)
+		close(updates)
+	}
+
+	if d == 0 {
+		return
+	}
+
+	generation := s.generation
+	time.AfterFunc(d, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.generation == generation && s.offline[name] {
+			s.reconnect(name)
+		}
+	})
+}
+
+// reconnect brings a robot back online, unless it is offline until faults change. It must be
+// called with the mutex held.
+func (s *Store) reconnect(name string) {
+	for _, offline := range s.faults.Offline {
+		if offline == name {
+			return
+		}
+	}
+
+	delete(s.offline, name)
+	log.Infof("robot %s is back online", name)
+	s.publish(s.robots[name])
+}
+
+// disconnectRandomly takes every robot that is online offline with probability s.faults.OfflineRate
+// every second, until ctx is done.
+func (s *Store) disconnectRandomly(ctx context.Context, generation int) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mutex.Lock()
+		if s.generation == generation {
+			for name := range s.robots {
+				if !s.offline[name] && s.chance(offlineFaults, name, s.faults.OfflineRate) {
+					s.disconnect(name, time.Duration(s.faults.OfflineFor))
+				}
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// newFaultsHandler returns the faults of the fleet server on GET, replaces them with the faults in
+// the body on PUT, and clears them on DELETE.
+func newFaultsHandler(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodPut:
+			f := Faults{}
+			if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			if err := s.SetFaults(f); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		case http.MethodDelete:
+			s.ClearFaults()
+		}
+
+		writeJSON(w, s.Faults())
+	}
+}
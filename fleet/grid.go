@@ -0,0 +1,297 @@
+package fleet
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ErrNoPath is returned when a robot cannot be sent to a target, because the target is inside an
+// obstacle or cannot be reached from where the robot is.
+var ErrNoPath = errors.New("no path to target")
+
+// Grid is an occupancy grid map. Every cell is either free or occupied by an obstacle, and
+// anything outside of the grid is considered occupied.
+type Grid struct {
+	Width  int
+	Height int
+
+	// Resolution is the size of a cell, and Origin the pose of the bottom left corner of the grid.
+	Resolution float64
+	Origin     Pose
+
+	// Docks are where robots charge, by name.
+	Docks map[string]Pose
+
+	occupied []bool
+}
+
+// LoadGrid reads a grid in a simple text format: every line is a row of cells, from the top of the
+// map to the bottom, where # is an obstacle and any other character is free. Lines of the form
+// "@dock <name> <x> <y>" declare a charging dock. Empty lines and lines starting with ; are
+// ignored.
+func LoadGrid(r io.Reader, resolution float64, origin Pose) (*Grid, error) {
+	if resolution <= 0 {
+		return nil, fmt.Errorf("map resolution must be positive, got %v", resolution)
+	}
+
+	rows := []string{}
+	docks := map[string]Pose{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "@dock") {
+			name, pose := "", Pose{}
+			if _, err := fmt.Sscanf(line, "@dock %s %g %g", &name, &pose.X, &pose.Y); err != nil {
+				return nil, fmt.Errorf("cannot read dock %q: %v", line, err)
+			}
+
+			docks[name] = pose
+			continue
+		}
+
+		rows = append(rows, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("map has no cell")
+	}
+
+	g := &Grid{Height: len(rows), Resolution: resolution, Origin: origin, Docks: docks}
+	for _, row := range rows {
+		if len(row) > g.Width {
+			g.Width = len(row)
+		}
+	}
+
+	g.occupied = make([]bool, g.Width*g.Height)
+	for i, row := range rows {
+		// The first row is the top of the map.
+		y := g.Height - 1 - i
+		for x := 0; x < g.Width; x++ {
+			g.occupied[y*g.Width+x] = x < len(row) && row[x] == '#'
+		}
+	}
+
+	for name, pose := range docks {
+		if g.Occupied(pose) {
+			return nil, fmt.Errorf("dock %s at (%v, %v) is inside an obstacle", name, pose.X, pose.Y)
+		}
+	}
+
+	return g, nil
+}
+
+// LoadMap loads the grid referenced by map.file in the config. It returns nil when no map is
+// configured, in which case robots move in straight lines.
+func LoadMap() (*Grid, error) {
+	path := viper.GetString("map.file")
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	resolution := viper.GetFloat64("map.resolution")
+	if resolution == 0 {
+		resolution = 1
+	}
+
+	return LoadGrid(f, resolution, Pose{X: viper.GetFloat64("map.origin_x"), Y: viper.GetFloat64("map.origin_y")})
+}
+
+type cell struct {
+	x, y int
+}
+
+// cell returns the cell that p falls into, which may be outside of the grid.
+func (g *Grid) cell(p Pose) cell {
+	return cell{
+		x: int(math.Floor((p.X - g.Origin.X) / g.Resolution)),
+		y: int(math.Floor((p.Y - g.Origin.Y) / g.Resolution)),
+	}
+}
+
+// center returns the pose at the center of c.
+func (g *Grid) center(c cell) Pose {
+	return Pose{
+		X: g.Origin.X + (float64(c.x)+0.5)*g.Resolution,
+		Y: g.Origin.Y + (float64(c.y)+0.5)*g.Resolution,
+	}
+}
+
+func (g *Grid) blocked(c cell) bool {
+	if c.x < 0 || c.y < 0 || c.x >= g.Width || c.y >= g.Height {
+		return true
+	}
+
+	return g.occupied[c.y*g.Width+c.x]
+}
+
+// Occupied reports whether p is inside an obstacle or outside of the grid.
+func (g *Grid) Occupied(p Pose) bool {
+	return g.blocked(g.cell(p))
+}
+
+// Plan returns the waypoints of the shortest path from one pose to another that avoids every
+// obstacle, found with A* on the cells of the grid. The path ends at to, and does not include
+// from. Robots may move diagonally, but never cut the corner of an obstacle.
+func (g *Grid) Plan(from, to Pose) ([]Pose, error) {
+	return g.plan(from, to, nil)
+}
+
+// plan is Plan, where the cells in avoid are obstacles too.
+func (g *Grid) plan(from, to Pose, avoid map[cell]bool) ([]Pose, error) {
+	if g.Occupied(to) || avoid[g.cell(to)] {
+		return nil, fmt.Errorf("target (%v, %v) is inside an obstacle: %w", to.X, to.Y, ErrNoPath)
+	}
+
+	start, goal := g.cell(from), g.cell(to)
+	if start == goal {
+		return []Pose{to}, nil
+	}
+
+	heuristic := func(c cell) float64 {
+		dx, dy := math.Abs(float64(c.x-goal.x)), math.Abs(float64(c.y-goal.y))
+		return math.Max(dx, dy) + (math.Sqrt2-1)*math.Min(dx, dy)
+	}
+
+	cost := map[cell]float64{start: 0}
+	came := map[cell]cell{}
+	open := &frontier{{cell: start, priority: heuristic(start)}}
+	for open.Len() > 0 {
+		current := heap.Pop(open).(*node).cell
+		if current == goal {
+			return g.smooth(from, g.walk(came, start, goal), to, avoid), nil
+		}
+
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				next := cell{current.x + dx, current.y + dy}
+				if next == current || g.blocked(next) || avoid[next] {
+					continue
+				}
+
+				step := 1.0
+				if dx != 0 && dy != 0 {
+					side, other := cell{current.x + dx, current.y}, cell{current.x, current.y + dy}
+					if g.blocked(side) || g.blocked(other) || avoid[side] || avoid[other] {
+						continue
+					}
+
+					step = math.Sqrt2
+				}
+
+				c := cost[current] + step
+				if known, ok := cost[next]; ok && known <= c {
+					continue
+				}
+
+				cost[next] = c
+				came[next] = current
+				heap.Push(open, &node{cell: next, priority: c + heuristic(next)})
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("target (%v, %v) is unreachable from (%v, %v): %w", to.X, to.Y, from.X, from.Y, ErrNoPath)
+}
+
+// walk returns the cells from start to goal, following the cell each one was reached from.
+func (g *Grid) walk(came map[cell]cell, start, goal cell) []cell {
+	cells := []cell{goal}
+	for c := goal; c != start; {
+		c = came[c]
+		cells = append(cells, c)
+	}
+
+	for i, j := 0, len(cells)-1; i < j; i, j = i+1, j-1 {
+		cells[i], cells[j] = cells[j], cells[i]
+	}
+
+	return cells
+}
+
+// smooth turns the cells of a path into waypoints, skipping every cell that can be cut across in
+// a straight line.
+func (g *Grid) smooth(from Pose, cells []cell, to Pose, avoid map[cell]bool) []Pose {
+	poses := make([]Pose, 0, len(cells)+1)
+	for _, c := range cells[1 : len(cells)-1] {
+		poses = append(poses, g.center(c))
+	}
+	poses = append(poses, to)
+
+	waypoints := []Pose{}
+	current := from
+	for i := 0; i < len(poses); {
+		// Head for the furthest pose that is in sight, or the next one.
+		next := i
+		for j := len(poses) - 1; j > i; j-- {
+			if g.clear(current, poses[j], avoid) {
+				next = j
+				break
+			}
+		}
+
+		waypoints = append(waypoints, poses[next])
+		current = poses[next]
+		i = next + 1
+	}
+
+	return waypoints
+}
+
+// clear reports whether the straight line between two poses stays away from obstacles, and from
+// the cells in avoid.
+func (g *Grid) clear(a, b Pose, avoid map[cell]bool) bool {
+	distance := math.Hypot(b.X-a.X, b.Y-a.Y)
+	steps := int(math.Ceil(distance / (g.Resolution / 4)))
+	for i := 1; i < steps; i++ {
+		t := float64(i) / float64(steps)
+		c := g.cell(Pose{X: a.X + (b.X-a.X)*t, Y: a.Y + (b.Y-a.Y)*t})
+		if g.blocked(c) || avoid[c] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// node is a cell on the frontier of A*, ordered by its estimated cost to the goal.
+type node struct {
+	cell     cell
+	priority float64
+}
+
+type frontier []*node
+
+func (f frontier) Len() int            { return len(f) }
+func (f frontier) Less(i, j int) bool  { return f[i].priority < f[j].priority }
+func (f frontier) Swap(i, j int)       { f[i], f[j] = f[j], f[i] }
+func (f *frontier) Push(x interface{}) { *f = append(*f, x.(*node)) }
+
+func (f *frontier) Pop() interface{} {
+	old := *f
+	n := old[len(old)-1]
+	*f = old[:len(old)-1]
+	return n
+}
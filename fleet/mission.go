@@ -0,0 +1,240 @@
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// MissionStatus describes where a mission is at.
+type MissionStatus string
+
+// Statuses of a mission.
+const (
+	MissionActive    MissionStatus = "ACTIVE"
+	MissionCompleted MissionStatus = "COMPLETED"
+	MissionCancelled MissionStatus = "CANCELLED"
+	MissionPreempted MissionStatus = "PREEMPTED"
+
+	// MissionBlocked means that the robot was kept from reaching the target by other robots for
+	// too long, see Traffic.
+	MissionBlocked MissionStatus = "BLOCKED"
+
+	// MissionFailed means that the robot stopped on its way, because its battery is empty or it
+	// broke down.
+	MissionFailed MissionStatus = "FAILED"
+)
+
+// OverlapPolicy decides what happens when a robot that is on a mission is sent on another one.
+type OverlapPolicy string
+
+// Overlap policies, robot.overlap in the config sets the default one.
+const (
+	// PreemptMission cancels the mission in progress in favor of the new one.
+	PreemptMission OverlapPolicy = "preempt"
+
+	// RejectMission refuses the new mission.
+	RejectMission OverlapPolicy = "reject"
+)
+
+// ErrRobotBusy is returned when a mission is rejected because its robot is on another one.
+var ErrRobotBusy = errors.New("robot is on another mission")
+
+// Mission takes a robot to a target.
+type Mission struct {
+	ID      int           `json:"id"`
+	Robot   string        `json:"robot"`
+	Target  Pose          `json:"target"`
+	Status  MissionStatus `json:"status"`
+	Created time.Time     `json:"created"`
+
+	// Path holds the waypoints the robot goes through, the last one being the target.
+	Path []Pose `json:"path"`
+
+	// Dock is set when the robot charges at the target, until its battery is full.
+	Dock string `json:"dock,omitempty"`
+
+	// Ended is nil while the mission is active.
+	Ended *time.Time `json:"ended,omitempty"`
+}
+
+// mission is a mission along with the means to stop the robot carrying it out.
+type mission struct {
+	Mission
+	cancel context.CancelFunc
+
+	// next is the waypoint of the path the robot is heading for, and blockedSince when the robot
+	// started waiting for another robot to get out of its way, if it is waiting. reserved holds
+	// the cells ahead of the robot that it reserved, see Traffic.
+	next         int
+	blockedSince time.Time
+	reserved     []cell
+
+	// stuck is set when the robot got stuck, see Faults.
+	stuck bool
+}
+
+func (m *mission) end(status MissionStatus) {
+	now := time.Now()
+	m.Status = status
+	m.Ended = &now
+	m.cancel()
+}
+
+func (m *mission) clone() Mission {
+	copy := m.Mission
+	copy.Path = append([]Pose(nil), m.Path...)
+	if m.Ended != nil {
+		ended := *m.Ended
+		copy.Ended = &ended
+	}
+
+	return copy
+}
+
+func overlapPolicy(policy OverlapPolicy) (OverlapPolicy, error) {
+	if policy == "" {
+		policy = OverlapPolicy(viper.GetString("robot.overlap"))
+	}
+
+	switch policy {
+	case PreemptMission, RejectMission:
+		return policy, nil
+	case "":
+		return PreemptMission, nil
+	default:
+		return "", fmt.Errorf("unknown overlap policy %q, expected %s or %s", policy, PreemptMission, RejectMission)
+	}
+}
+
+func newSendRobotHandler(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		decoder := json.NewDecoder(r.Body)
+
+		target := Pose{}
+		if err := decoder.Decode(&target); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		vars := mux.Vars(r)
+		policy := OverlapPolicy(r.URL.Query().Get("policy"))
+		m, err := s.Send(vars["robot"], target, policy)
+		if err != nil {
+			writeMissionError(w, err)
+			return
+		}
+
+		writeJSON(w, m)
+	}
+}
+
+// newChargeRobotHandler sends a robot to charge at the dock named in the body, or at the nearest
+// dock when the body is empty.
+func newChargeRobotHandler(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		req := struct {
+			Dock string `json:"dock"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		vars := mux.Vars(r)
+		policy := OverlapPolicy(r.URL.Query().Get("policy"))
+		m, err := s.Charge(vars["robot"], req.Dock, policy)
+		if err != nil {
+			writeMissionError(w, err)
+			return
+		}
+
+		writeJSON(w, m)
+	}
+}
+
+func newCancelMissionHandler(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		vars := mux.Vars(r)
+		if s.GetRobot(vars["robot"]) == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("robot %s does not exist", vars["robot"])))
+			return
+		}
+
+		m := s.CancelMission(vars["robot"])
+		if m == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("robot %s has no mission in progress", vars["robot"])))
+			return
+		}
+
+		writeJSON(w, m)
+	}
+}
+
+func newMissionHandler(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("mission id %q is not a number", vars["id"])))
+			return
+		}
+
+		m := s.GetMission(id)
+		if m == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("mission %d does not exist", id)))
+			return
+		}
+
+		writeJSON(w, m)
+	}
+}
+
+// writeMissionError tells why a mission could not be started.
+func writeMissionError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrRobotBusy) {
+		status = http.StatusConflict
+	} else if errors.Is(err, ErrNoPath) || errors.Is(err, ErrBatteryEmpty) || errors.Is(err, ErrNoDock) {
+		status = http.StatusUnprocessableEntity
+	} else if errors.Is(err, ErrRobotOffline) {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.WriteHeader(status)
+	w.Write([]byte(err.Error()))
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
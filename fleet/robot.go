@@ -1,12 +1,14 @@
 package fleet
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"time"
 
-	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -15,6 +17,15 @@ type Robot struct {
 	Name        string `json:"name"`
 	Status      string `json:"status"`
 	CurrentPose Pose   `json:"current_pose"`
+
+	// TargetPose is where the robot is heading, it is nil when the robot has no mission.
+	TargetPose *Pose `json:"target_pose,omitempty"`
+
+	// BlockedBy is the robot that is in the way of a BLOCKED robot.
+	BlockedBy string `json:"blocked_by,omitempty"`
+
+	// Battery is the charge left in the battery, in percent.
+	Battery float64 `json:"battery"`
 }
 
 // Pose is like a coordinate.
@@ -23,11 +34,11 @@ type Pose struct {
 	Y float64 `json:"y"`
 }
 
-func newRobotListHandler() http.HandlerFunc {
+func newRobotListHandler(s *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		robots := store.GetRobots()
+		robots := s.GetRobots()
 
 		bytes, err := json.Marshal(robots)
 		if err != nil {
@@ -41,42 +52,143 @@ func newRobotListHandler() http.HandlerFunc {
 	}
 }
 
-func newSendRobotHandler() http.HandlerFunc {
+// newRobotEventsHandler streams robots as server-sent events. Every robot is sent once when the
+// stream opens, followed by a sync event, then again every time it changes.
+func newRobotEventsHandler(s *Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("streaming is not supported"))
+			return
+		}
 
-		decoder := json.NewDecoder(r.Body)
+		// Subscribe first so that no change is missed while the current robots are sent.
+		updates, unsubscribe := s.Subscribe()
+		defer unsubscribe()
 
-		target := Pose{}
-		if err := decoder.Decode(&target); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		for _, robot := range s.GetRobots() {
+			writeEvent(w, "robot", robot)
+		}
+		writeEvent(w, "sync", struct{}{})
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case robot, ok := <-updates:
+				if !ok {
+					return
+				}
+
+				writeEvent(w, "robot", robot)
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, data interface{}) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, bytes)
+}
+
+// navigate moves the robot of a mission through the waypoints of its path at robot.velocity, and
+// charges it when the mission ends at a dock, until the mission ends.
+func (s *Store) navigate(ctx context.Context, m *mission) {
+	interval := viper.GetDuration("robot.update_intv")
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-time.After(interval):
 		}
 
-		vars := mux.Vars(r)
-		robot := store.GetRobot(vars["robot"])
-		if robot == nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("robot %s does not exist", vars["robot"])))
+		if !s.step(m, interval) {
 			return
 		}
+	}
+}
 
-		go navigate(vars["robot"], robot.CurrentPose, target)
+// step moves the robot of m along its path for interval, unless another robot is in its way or m
+// is no longer its mission, or charges it once it has arrived at the dock of m. Robots use
+// battery.drain_per_meter percent of their battery per meter they move, and stop when it is
+// empty. Robots may also get stuck or break down, see Faults. It reports whether m goes on.
+func (s *Store) step(m *mission, interval time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.robots[m.Robot]
+	if !ok || s.active[m.Robot] != m {
+		return false
+	}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte{})
+	s.settle(r)
+	if m.next == len(m.Path) {
+		return s.charge(m, r, interval)
+	}
+
+	if r.Battery <= 0 {
+		log.Warnf("robot %s stopped on mission %d, its battery is empty", r.Name, m.ID)
+		s.finish(m, r, MissionFailed)
+		return false
+	}
+
+	if goesOn, failed := s.fail(m, r); failed {
+		return goesOn
+	}
+
+	waypoint := m.Path[m.next]
+	pose := toward(r.CurrentPose, waypoint, viper.GetFloat64("robot.velocity")*interval.Seconds())
+	s.reserve(m, r)
+	if holder := s.obstruction(r, pose); holder != "" {
+		return s.wait(m, r, holder)
 	}
+
+	moved := math.Hypot(pose.X-r.CurrentPose.X, pose.Y-r.CurrentPose.Y)
+	r.Battery = clampBattery(r.Battery - moved*viper.GetFloat64("battery.drain_per_meter"))
+
+	m.blockedSince = time.Time{}
+	r.Status = "WORKING"
+	r.BlockedBy = ""
+	r.CurrentPose = pose
+	if pose == waypoint {
+		m.next++
+	}
+
+	s.reserve(m, r)
+
+	if m.next < len(m.Path) {
+		s.publish(r)
+		return true
+	}
+
+	if m.Dock != "" {
+		r.Status = StatusCharging
+		s.publish(r)
+		return true
+	}
+
+	s.finish(m, r, MissionCompleted)
+	return false
 }
 
-func navigate(robot string, current, target Pose) {
-	dX := (target.X - current.X) / 20
-	dY := (target.Y - current.Y) / 20
-	for i := 1; i <= 20; i++ {
-		time.Sleep(viper.GetDuration("robot.update_intv"))
-		newPose := Pose{X: current.X + dX*float64(i), Y: current.Y + dY*float64(i)}
-		store.UpdateRobot(robot, "WORKING", newPose)
+// toward returns the pose reached by moving from one pose to another by at most step. Any step
+// that is not positive goes all the way.
+func toward(from, to Pose, step float64) Pose {
+	distance := math.Hypot(to.X-from.X, to.Y-from.Y)
+	if step <= 0 || distance <= step {
+		return to
 	}
 
-	store.UpdateRobot(robot, "IDLE", target)
+	return Pose{X: from.X + (to.X-from.X)/distance*step, Y: from.Y + (to.Y-from.Y)/distance*step}
 }
@@ -8,11 +8,23 @@ import (
 	"github.com/spf13/viper"
 )
 
-// LoadRoutes returns routes.
+// LoadRoutes returns the routes of the API that serve the default store.
 func LoadRoutes() http.Handler {
+	return Routes(store)
+}
+
+// Routes returns the routes of the API that serve s.
+func Routes(s *Store) http.Handler {
 	r := mux.NewRouter().StrictSlash(true)
-	r.Handle("/api/robots/", newRobotListHandler()).Methods(http.MethodGet)
-	r.Handle("/api/robots/{robot}/send/", newSendRobotHandler()).Methods(http.MethodPatch)
+	r.Handle("/api/robots/", newRobotListHandler(s)).Methods(http.MethodGet)
+	r.Handle("/api/robots/events/", newRobotEventsHandler(s)).Methods(http.MethodGet)
+	r.Handle("/api/robots/{robot}/send/", newSendRobotHandler(s)).Methods(http.MethodPatch)
+	r.Handle("/api/robots/{robot}/charge/", newChargeRobotHandler(s)).Methods(http.MethodPatch)
+	r.Handle("/api/robots/{robot}/mission/", newCancelMissionHandler(s)).Methods(http.MethodDelete)
+	r.Handle("/api/missions/{id}/", newMissionHandler(s)).Methods(http.MethodGet)
+	r.Handle("/api/_faults/", newFaultsHandler(s)).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	r.Handle("/api/_robots/{robot}/", newPlaceRobotHandler(s)).Methods(http.MethodPut)
+	r.Use(s.injectFaults)
 	return r
 }
 
@@ -1,16 +1,36 @@
 package fleet
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 var store *Store
 
+// Default returns the store served by the mock fleet server.
+func Default() *Store {
+	return store
+}
+
 func init() {
-	store = &Store{
-		robots: make(map[string]*Robot),
-		mutex:  &sync.Mutex{},
+	store = NewStore()
+}
+
+// NewStore returns a store of its own with freight1, freight2 and freight3 IDLE at (0, 0) with a
+// full battery.
+func NewStore() *Store {
+	s := &Store{
+		robots:      make(map[string]*Robot),
+		missions:    make(map[int]*mission),
+		active:      make(map[string]*mission),
+		subscribers: make(map[int]chan Robot),
+		settled:     make(map[string]time.Time),
+		offline:     make(map[string]bool),
+		sources:     make(map[string]*rand.Rand),
+		mutex:       &sync.Mutex{},
 	}
 
 	for i := 1; i <= 3; i++ {
@@ -18,38 +38,110 @@ func init() {
 			Name:        fmt.Sprintf("freight%d", i),
 			Status:      "IDLE",
 			CurrentPose: Pose{0, 0},
+			Battery:     100,
 		}
-		store.robots[robot.Name] = robot
+		s.robots[robot.Name] = robot
 	}
+
+	return s
 }
 
 // Store keeps a list of resources on this mock server.
 type Store struct {
 	robots map[string]*Robot
 	mutex  *sync.Mutex
+
+	// missions holds every mission by ID until retention after it ended, and active the mission
+	// each robot is on.
+	missions    map[int]*mission
+	active      map[string]*mission
+	nextMission int
+	retention   time.Duration
+
+	subscribers    map[int]chan Robot
+	nextSubscriber int
+
+	// grid is the map robots find their way through, they move in straight lines without one.
+	grid *Grid
+
+	// traffic keeps robots from running into each other, they go through each other without it.
+	traffic *Traffic
+
+	// settled is when the battery of each robot was last brought up to date.
+	settled map[string]time.Time
+
+	// faults make the server misbehave, drawing random faults from sources derived from seed, by
+	// kind of fault and robot. offline holds the robots that are offline, generation counts the
+	// changes to faults, and stopFaults stops the robots from going offline randomly.
+	faults     Faults
+	seed       int64
+	sources    map[string]*rand.Rand
+	offline    map[string]bool
+	generation int
+	stopFaults context.CancelFunc
+}
+
+// SetGrid makes robots find their way around the obstacles of grid. Robots move in straight
+// lines when grid is nil.
+func (s *Store) SetGrid(grid *Grid) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.grid = grid
+}
+
+// SetMissionRetention makes the store forget missions once they ended more than retention ago, or
+// keeps every mission when retention is zero.
+func (s *Store) SetMissionRetention(retention time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.retention = retention
+	s.prune()
+}
+
+// prune forgets the missions that ended more than the retention ago. It must be called with the
+// mutex held.
+func (s *Store) prune() {
+	if s.retention <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-s.retention)
+	for id, m := range s.missions {
+		if m.Ended != nil && m.Ended.Before(cutoff) {
+			delete(s.missions, id)
+		}
+	}
 }
 
 // GetRobot checks whether a robot exists in store.
-func (s Store) GetRobot(name string) *Robot {
+func (s *Store) GetRobot(name string) *Robot {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if r, ok := s.robots[name]; ok {
-		copy := *r
+		s.settle(r)
+		copy := r.clone()
 		return &copy
 	}
 
 	return nil
 }
 
-// GetRobots returns a list of robot in store.
+// GetRobots returns a list of robot in store, leaving out the robots that are offline.
 func (s *Store) GetRobots() []*Robot {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	results := make([]*Robot, 0, len(s.robots))
 	for _, r := range s.robots {
-		copy := *r
+		if s.offline[r.Name] {
+			continue
+		}
+
+		s.settle(r)
+		copy := r.clone()
 		results = append(results, &copy)
 	}
 
@@ -64,5 +156,213 @@ func (s *Store) UpdateRobot(name, status string, pose Pose) {
 	if _, ok := s.robots[name]; ok {
 		s.robots[name].Status = status
 		s.robots[name].CurrentPose = pose
+		s.publish(s.robots[name])
+	}
+}
+
+// Send starts a mission that takes a robot to target. When the robot is already on a mission,
+// policy decides whether that mission is preempted or the new one is rejected with ErrRobotBusy.
+// An empty policy falls back to robot.overlap in the config. The mission fails with ErrNoPath
+// when the map has no way to target, and with ErrBatteryEmpty when the robot cannot move.
+func (s *Store) Send(name string, target Pose, policy OverlapPolicy) (*Mission, error) {
+	policy, err := overlapPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dispatch(name, policy, func(*Robot) (Pose, string, error) {
+		return target, "", nil
+	})
+}
+
+// dispatch sends robot name on a mission to the target that destination picks for it with the
+// mutex held, along with the dock the mission ends at, if any. The path is planned without holding
+// the mutex, against the pose of the robot and the map at the time, so that other robots carry on
+// in the meantime. It is planned again when either has changed by the time the mission starts.
+func (s *Store) dispatch(name string, policy OverlapPolicy, destination func(r *Robot) (Pose, string, error)) (*Mission, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		r, ok := s.robots[name]
+		if !ok {
+			return nil, fmt.Errorf("robot %s does not exist", name)
+		}
+
+		target, dock, err := destination(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.sendable(r, target, policy); err != nil {
+			return nil, err
+		}
+
+		grid, from := s.grid, r.CurrentPose
+		s.mutex.Unlock()
+
+		path := []Pose{target}
+		if grid != nil {
+			path, err = grid.Plan(from, target)
+		}
+
+		s.mutex.Lock()
+		if s.grid != grid || r.CurrentPose != from {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot send robot %s: %w", name, err)
+		}
+
+		// The robot may have gone offline or been sent elsewhere while the path was planned.
+		if err := s.sendable(r, target, policy); err != nil {
+			return nil, err
+		}
+
+		return s.start(r, target, dock, path), nil
 	}
 }
+
+// sendable returns why r cannot be sent on a mission to target, if it cannot. It must be called
+// with the mutex held.
+func (s *Store) sendable(r *Robot, target Pose, policy OverlapPolicy) error {
+	if s.offline[r.Name] {
+		return fmt.Errorf("cannot send robot %s: %w", r.Name, ErrRobotOffline)
+	}
+
+	if current, busy := s.active[r.Name]; busy && policy == RejectMission {
+		return fmt.Errorf("cannot send robot %s to (%v, %v): %w, mission %d", r.Name, target.X, target.Y, ErrRobotBusy, current.ID)
+	}
+
+	s.settle(r)
+	if r.Battery <= 0 && r.CurrentPose != target {
+		return fmt.Errorf("cannot send robot %s: %w", r.Name, ErrBatteryEmpty)
+	}
+
+	return nil
+}
+
+// start sends r on a mission along path to target, which ends at dock when it is set. It must be
+// called with the mutex held.
+func (s *Store) start(r *Robot, target Pose, dock string, path []Pose) *Mission {
+	if current, busy := s.active[r.Name]; busy {
+		current.end(MissionPreempted)
+		delete(s.active, r.Name)
+	}
+
+	s.prune()
+	s.nextMission++
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &mission{
+		Mission: Mission{ID: s.nextMission, Robot: r.Name, Target: target, Dock: dock, Path: path, Status: MissionActive, Created: time.Now()},
+		cancel:  cancel,
+	}
+	s.missions[m.ID] = m
+	s.active[r.Name] = m
+
+	r.Status = "WORKING"
+	r.TargetPose = &target
+	s.publish(r)
+
+	go s.navigate(ctx, m)
+
+	copy := m.clone()
+	return &copy
+}
+
+// finish ends m with status, and leaves its robot IDLE where it is. It must be called with the
+// mutex held.
+func (s *Store) finish(m *mission, r *Robot, status MissionStatus) {
+	m.end(status)
+	delete(s.active, r.Name)
+
+	r.Status = "IDLE"
+	r.TargetPose = nil
+	r.BlockedBy = ""
+	s.publish(r)
+}
+
+// GetMission returns the mission with the given ID, whether it has ended or not, unless it ended
+// long enough ago to be forgotten.
+func (s *Store) GetMission(id int) *Mission {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if m, ok := s.missions[id]; ok {
+		copy := m.clone()
+		return &copy
+	}
+
+	return nil
+}
+
+// CancelMission stops the mission of a robot where the robot is. It returns the cancelled
+// mission, or nil if the robot has none.
+func (s *Store) CancelMission(name string) *Mission {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, ok := s.active[name]
+	if !ok {
+		return nil
+	}
+
+	s.finish(m, s.robots[name], MissionCancelled)
+
+	copy := m.clone()
+	return &copy
+}
+
+// Subscribe returns a channel that receives a copy of a robot every time it changes, along with
+// the function that unsubscribes. A subscriber that falls too far behind is unsubscribed and its
+// channel is closed.
+func (s *Store) Subscribe() (<-chan Robot, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nextSubscriber++
+	id := s.nextSubscriber
+
+	updates := make(chan Robot, 64)
+	s.subscribers[id] = updates
+
+	return updates, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if _, ok := s.subscribers[id]; ok {
+			delete(s.subscribers, id)
+			close(updates)
+		}
+	}
+}
+
+// publish sends a copy of r to every subscriber, unless r is offline or the change is dropped.
+// It must be called with the mutex held.
+func (s *Store) publish(r *Robot) {
+	s.settle(r)
+	if s.dropped(r) {
+		return
+	}
+
+	for id, updates := range s.subscribers {
+		select {
+		case updates <- r.clone():
+		default:
+			delete(s.subscribers, id)
+			close(updates)
+		}
+	}
+}
+
+// clone returns a copy of r that shares nothing with it.
+func (r *Robot) clone() Robot {
+	copy := *r
+	if r.TargetPose != nil {
+		target := *r.TargetPose
+		copy.TargetPose = &target
+	}
+
+	return copy
+}
@@ -0,0 +1,287 @@
+package fleet
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// StatusBlocked is the status of a robot on a mission that waits for another robot to get out of
+// its way.
+const StatusBlocked = "BLOCKED"
+
+// Traffic keeps robots from running into each other. Every robot holds the cell it is in, and a
+// robot on a mission also reserves the cells along its path for ReserveAhead ahead of it, up to
+// the first cell held by another robot, and releases them as it goes past them. A robot only moves
+// into cells that no other robot holds, so robots whose paths cross give way to the one that
+// reserved the crossing first. It waits as BLOCKED otherwise, looks for another way around when it
+// has waited for RerouteAfter, and gives its mission up when it has waited for GiveUpAfter.
+type Traffic struct {
+	// CellSize is the size of the cells robots hold when there is no map, otherwise they hold the
+	// cells of the map.
+	CellSize float64
+
+	// ReserveAhead is how far along their path robots reserve cells. Robots only hold the cell
+	// they are in when it is zero.
+	ReserveAhead float64
+
+	// RerouteAfter and GiveUpAfter are disabled when they are zero.
+	RerouteAfter time.Duration
+	GiveUpAfter  time.Duration
+}
+
+// LoadTraffic returns the traffic rules of the traffic section in the config, or nil when they are
+// disabled, in which case robots go through each other.
+func LoadTraffic() *Traffic {
+	if !viper.GetBool("traffic.enabled") {
+		return nil
+	}
+
+	t := &Traffic{
+		CellSize:     viper.GetFloat64("traffic.cell_size"),
+		ReserveAhead: viper.GetFloat64("traffic.reserve_ahead"),
+		RerouteAfter: viper.GetDuration("traffic.reroute_after"),
+		GiveUpAfter:  viper.GetDuration("traffic.give_up_after"),
+	}
+
+	if t.CellSize <= 0 {
+		t.CellSize = 1
+	}
+
+	return t
+}
+
+// SetTraffic makes robots follow the traffic rules of t, or go through each other when t is nil.
+func (s *Store) SetTraffic(t *Traffic) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.traffic = t
+}
+
+// cellOf returns the cell that p falls into. It must be called with traffic rules set.
+func (s *Store) cellOf(p Pose) cell {
+	if s.grid != nil {
+		return s.grid.cell(p)
+	}
+
+	return cell{
+		x: int(math.Floor(p.X / s.traffic.CellSize)),
+		y: int(math.Floor(p.Y / s.traffic.CellSize)),
+	}
+}
+
+// obstruction returns the robot that holds a cell on the way of r to pose, if any. It must be
+// called with the mutex held.
+func (s *Store) obstruction(r *Robot, pose Pose) string {
+	if s.traffic == nil {
+		return ""
+	}
+
+	held := s.holders(r)
+	for _, c := range s.cellsAhead(r.CurrentPose, []Pose{pose}, math.Inf(1)) {
+		if holder, ok := held[c]; ok {
+			return holder
+		}
+	}
+
+	return ""
+}
+
+// reserve has the robot of m reserve the cells along the rest of its path for ReserveAhead, up to
+// the first cell held by another robot, and release the cells it no longer needs. It must be
+// called with the mutex held.
+func (s *Store) reserve(m *mission, r *Robot) {
+	m.reserved = nil
+	if s.traffic == nil || s.traffic.ReserveAhead <= 0 {
+		return
+	}
+
+	held := s.holders(r)
+	for _, c := range s.cellsAhead(r.CurrentPose, m.Path[m.next:], s.traffic.ReserveAhead) {
+		if _, ok := held[c]; ok {
+			break
+		}
+
+		m.reserved = append(m.reserved, c)
+	}
+}
+
+// holders returns the robot that holds each cell held by robots other than r, because the robot
+// is in the cell or reserved it. It must be called with the mutex held.
+func (s *Store) holders(r *Robot) map[cell]string {
+	held := map[cell]string{}
+	names := s.names()
+	for _, name := range names {
+		c := s.cellOf(s.robots[name].CurrentPose)
+		if _, ok := held[c]; !ok && name != r.Name {
+			held[c] = name
+		}
+	}
+
+	for _, name := range names {
+		m, ok := s.active[name]
+		if !ok || name == r.Name {
+			continue
+		}
+
+		for _, c := range m.reserved {
+			if _, ok := held[c]; !ok {
+				held[c] = name
+			}
+		}
+	}
+
+	return held
+}
+
+// cellsAhead returns the cells a robot at from goes through, in order, when it follows waypoints
+// for at most limit, leaving out the cell it is in. It must be called with traffic rules set.
+func (s *Store) cellsAhead(from Pose, waypoints []Pose, limit float64) []cell {
+	size := s.traffic.CellSize
+	if s.grid != nil {
+		size = s.grid.Resolution
+	}
+
+	seen := map[cell]bool{s.cellOf(from): true}
+	cells := []cell{}
+	for _, to := range waypoints {
+		if limit <= 0 {
+			break
+		}
+
+		distance := math.Hypot(to.X-from.X, to.Y-from.Y)
+		if distance > limit {
+			to, distance = toward(from, to, limit), limit
+		}
+
+		steps := int(math.Ceil(distance / (size / 4)))
+		for i := 1; i <= steps; i++ {
+			t := float64(i) / float64(steps)
+			c := s.cellOf(Pose{X: from.X + (to.X-from.X)*t, Y: from.Y + (to.Y-from.Y)*t})
+			if !seen[c] {
+				seen[c] = true
+				cells = append(cells, c)
+			}
+		}
+
+		from, limit = to, limit-distance
+	}
+
+	return cells
+}
+
+// wait keeps the robot of m where it is, because holder is in its way. It returns false when the
+// mission is given up.
+func (s *Store) wait(m *mission, r *Robot, holder string) bool {
+	now := time.Now()
+	if m.blockedSince.IsZero() {
+		m.blockedSince = now
+	}
+
+	changed := r.Status != StatusBlocked || r.BlockedBy != holder
+	r.Status = StatusBlocked
+	r.BlockedBy = holder
+
+	// When robots wait for each other, the one that comes last by name yields and looks for
+	// another way around.
+	cycle := s.deadlock(r.Name)
+	yields := len(cycle) > 0 && cycle[len(cycle)-1] == r.Name
+	if len(cycle) > 0 && changed {
+		log.Warnf("robots %s are deadlocked, %s yields", strings.Join(cycle, ", "), cycle[len(cycle)-1])
+	}
+
+	waited := now.Sub(m.blockedSince)
+	if yields || (s.traffic.RerouteAfter > 0 && waited >= s.traffic.RerouteAfter) {
+		rerouted := s.reroute(m, r)
+		if s.active[r.Name] != m {
+			// The mission ended while the robot looked for another way.
+			return false
+		}
+
+		if rerouted {
+			log.Infof("robot %s found another way around %s", r.Name, holder)
+			s.reserve(m, r)
+			s.publish(r)
+			return true
+		}
+	}
+
+	if s.traffic.GiveUpAfter > 0 && waited >= s.traffic.GiveUpAfter {
+		log.Warnf("robot %s gave mission %d up, it has been blocked by %s for %s", r.Name, m.ID, holder, waited.Round(time.Millisecond))
+		s.finish(m, r, MissionBlocked)
+		return false
+	}
+
+	if changed {
+		s.publish(r)
+	}
+
+	return true
+}
+
+// deadlock returns the robots that wait for each other along with robot name, sorted by name, or
+// nil if name does not wait for itself through other robots.
+func (s *Store) deadlock(name string) []string {
+	cycle := []string{name}
+	seen := map[string]bool{name: true}
+	for next := s.robots[name].BlockedBy; next != ""; next = s.robots[next].BlockedBy {
+		if next == name {
+			sort.Strings(cycle)
+			return cycle
+		}
+
+		if seen[next] || s.robots[next] == nil {
+			return nil
+		}
+
+		seen[next] = true
+		cycle = append(cycle, next)
+	}
+
+	return nil
+}
+
+// reroute replaces the rest of the path of m with one that goes around the cells held by other
+// robots, when there is a map to find it on. It reports whether it did. Like in dispatch, the path
+// is planned without holding the mutex, and dropped when the map, the mission of the robot or its
+// pose have changed in the meantime. It must be called with the mutex held.
+func (s *Store) reroute(m *mission, r *Robot) bool {
+	if s.grid == nil {
+		return false
+	}
+
+	avoid := map[cell]bool{}
+	for c := range s.holders(r) {
+		avoid[c] = true
+	}
+
+	grid, from, target := s.grid, r.CurrentPose, m.Target
+	s.mutex.Unlock()
+
+	path, err := grid.plan(from, target, avoid)
+
+	s.mutex.Lock()
+	if err != nil || s.grid != grid || s.active[r.Name] != m || r.CurrentPose != from {
+		return false
+	}
+
+	m.Path = path
+	m.next = 0
+	return true
+}
+
+// names returns the names of every robot in order. It must be called with the mutex held.
+func (s *Store) names() []string {
+	names := make([]string, 0, len(s.robots))
+	for name := range s.robots {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,102 @@
+package global
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"wf-engine/fleet"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// FleetAdapter is how the engine talks to a fleet manager.
+type FleetAdapter interface {
+	// ListRobots returns every robot of the fleet.
+	ListRobots(ctx context.Context) ([]*fleet.Robot, error)
+
+	// SendToPose starts a mission that takes robot to pose.
+	SendToPose(ctx context.Context, robot string, pose fleet.Pose) error
+
+	// CancelMission stops the mission robot is on.
+	CancelMission(ctx context.Context, robot string) error
+
+	// Subscribe streams changes to robots until ctx is done or the stream breaks, in which case
+	// the channel is closed. Every robot is sent first, then every robot that changes.
+	Subscribe(ctx context.Context) (<-chan []*fleet.Robot, error)
+}
+
+// ClientError is returned by a FleetAdapter when the fleet manager turns a request down, because
+// the robot does not exist, is busy or cannot reach the target for instance. Unlike a server or
+// network error, it is not worth sending the same request again.
+type ClientError struct {
+	Err error
+}
+
+func (e *ClientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClientError) Unwrap() error {
+	return e.Err
+}
+
+// Fleet adapters that can be selected with fleet.adapter in the config.
+const (
+	AdapterHTTP      = "http"
+	AdapterInProcess = "inprocess"
+)
+
+var (
+	fleetMutex   = &sync.RWMutex{}
+	fleetAdapter FleetAdapter
+)
+
+// NewFleetAdapter returns the adapter selected by fleet.adapter in the config. The fleet manager
+// at fleet.url, or the mock fleet server when it is not set, is reached over HTTP by default.
+func NewFleetAdapter() (FleetAdapter, error) {
+	switch adapter := viper.GetString("fleet.adapter"); adapter {
+	case AdapterHTTP, "":
+		return NewHTTPFleet(HTTPConfigFromViper())
+	case AdapterInProcess:
+		return NewInProcessFleet(fleet.Default()), nil
+	default:
+		return nil, fmt.Errorf("unknown fleet adapter %q, expected %s or %s", adapter, AdapterHTTP, AdapterInProcess)
+	}
+}
+
+// UseFleet makes the engine talk to the fleet through adapter.
+func UseFleet(adapter FleetAdapter) {
+	fleetMutex.Lock()
+	defer fleetMutex.Unlock()
+
+	fleetAdapter = adapter
+}
+
+// Fleet returns the adapter the engine talks to the fleet through. Unless UseFleet was called,
+// it is the adapter selected in the config, or the HTTP adapter of the mock fleet server when the
+// config is invalid.
+func Fleet() FleetAdapter {
+	fleetMutex.RLock()
+	adapter := fleetAdapter
+	fleetMutex.RUnlock()
+
+	if adapter != nil {
+		return adapter
+	}
+
+	fleetMutex.Lock()
+	defer fleetMutex.Unlock()
+
+	if fleetAdapter == nil {
+		adapter, err := NewFleetAdapter()
+		if err != nil {
+			log.Error(err)
+			adapter, _ = NewHTTPFleet(HTTPConfig{URL: fmt.Sprintf("http://localhost:%d", viper.GetInt("http.port"))})
+		}
+
+		fleetAdapter = adapter
+	}
+
+	return fleetAdapter
+}
@@ -1,42 +1,288 @@
 package global
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 	"wf-engine/fleet"
 
 	"github.com/spf13/viper"
 )
 
-func httpFetchRobotList() ([]*fleet.Robot, error) {
-	url := fmt.Sprintf("http://localhost:%d/api/robots/", viper.GetInt("http.port"))
+// HTTPConfig describes how to reach a fleet manager over HTTP.
+type HTTPConfig struct {
+	// URL is where the REST API of the fleet manager is served, without the /api prefix.
+	URL string
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	// Timeout bounds every request but the robot stream. Zero means no timeout.
+	Timeout time.Duration
+
+	// Token is sent as a bearer token. Username and Password are sent with basic auth instead.
+	Token    string
+	Username string
+	Password string
+
+	// CAFile is a PEM bundle of the authorities that the certificate of the fleet manager is
+	// checked against, on top of those of the system. CertFile and KeyFile hold a client
+	// certificate, for fleet managers that require one.
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// HTTPConfigFromViper reads the fleet section of the config. The URL defaults to the mock fleet
+// server served on http.port.
+func HTTPConfigFromViper() HTTPConfig {
+	url := viper.GetString("fleet.url")
+	if url == "" {
+		url = fmt.Sprintf("http://localhost:%d", viper.GetInt("http.port"))
+	}
+
+	return HTTPConfig{
+		URL:                url,
+		Timeout:            viper.GetDuration("fleet.timeout"),
+		Token:              viper.GetString("fleet.token"),
+		Username:           viper.GetString("fleet.username"),
+		Password:           viper.GetString("fleet.password"),
+		CAFile:             viper.GetString("fleet.ca_file"),
+		CertFile:           viper.GetString("fleet.cert_file"),
+		KeyFile:            viper.GetString("fleet.key_file"),
+		InsecureSkipVerify: viper.GetBool("fleet.insecure_skip_verify"),
+	}
+}
+
+// NewHTTPFleet returns a FleetAdapter for the REST API of the fleet manager described by conf.
+// Every request goes through a single client, so that connections are shared.
+func NewHTTPFleet(conf HTTPConfig) (FleetAdapter, error) {
+	if conf.URL == "" {
+		return nil, errors.New("fleet url is missing")
+	}
+
+	if conf.Token != "" && conf.Username != "" {
+		return nil, errors.New("fleet token and username cannot both be set")
+	}
+
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, errors.New("fleet cert_file and key_file must be set together")
+	}
+
+	tlsConfig, err := newTLSConfig(conf)
 	if err != nil {
 		return nil, err
 	}
 
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &httpFleet{
+		conf:    conf,
+		baseURL: strings.TrimSuffix(conf.URL, "/"),
+		client:  &http.Client{Transport: transport, Timeout: conf.Timeout},
+		// The robot stream stays open for as long as the engine runs, so it cannot be bounded
+		// by the request timeout. It shares the connections of client nonetheless.
+		stream: &http.Client{Transport: transport},
+	}, nil
+}
+
+func newTLSConfig(conf HTTPConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read fleet ca_file: %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("fleet ca_file %s holds no PEM certificate", conf.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load fleet client certificate: %v", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+type httpFleet struct {
+	conf    HTTPConfig
+	baseURL string
+	client  *http.Client
+	stream  *http.Client
+}
+
+func (f *httpFleet) ListRobots(ctx context.Context) ([]*fleet.Robot, error) {
+	res, err := f.do(ctx, http.MethodGet, "/api/robots/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	robots := []*fleet.Robot{}
+	if err := json.NewDecoder(res.Body).Decode(&robots); err != nil {
+		return nil, err
+	}
+
+	return robots, nil
+}
+
+func (f *httpFleet) SendToPose(ctx context.Context, robot string, pose fleet.Pose) error {
+	data, err := json.Marshal(pose)
+	if err != nil {
+		return err
+	}
+
+	res, err := f.do(ctx, http.MethodPatch, fmt.Sprintf("/api/robots/%s/send/", robot), data)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (f *httpFleet) CancelMission(ctx context.Context, robot string) error {
+	res, err := f.do(ctx, http.MethodDelete, fmt.Sprintf("/api/robots/%s/mission/", robot), nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// Subscribe reads the server-sent events of the fleet server. Robots sent before the sync event
+// are handed over together, as the first message.
+func (f *httpFleet) Subscribe(ctx context.Context) (<-chan []*fleet.Robot, error) {
+	res, err := f.send(ctx, f.stream, http.MethodGet, "/api/robots/events/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(chan []*fleet.Robot)
+	go func() {
+		defer close(updates)
+		defer res.Body.Close()
+
+		synced := false
+		robots := []*fleet.Robot{}
+		readEvents(res.Body, func(event, data string) bool {
+			switch event {
+			case "robot":
+				robot := &fleet.Robot{}
+				if err := json.Unmarshal([]byte(data), robot); err != nil {
+					return false
+				}
+
+				robots = append(robots, robot)
+				if !synced {
+					return true
+				}
+			case "sync":
+				synced = true
+			default:
+				return true
+			}
+
+			select {
+			case <-ctx.Done():
+				return false
+			case updates <- robots:
+			}
+
+			robots = []*fleet.Robot{}
+			return true
+		})
+	}()
+
+	return updates, nil
+}
+
+// readEvents calls handle with every server-sent event read from r, until handle returns false
+// or r is exhausted.
+func readEvents(r io.Reader, handle func(event, data string) bool) {
+	event := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if !handle(event, strings.TrimPrefix(line, "data: ")) {
+				return
+			}
+		}
+	}
+}
+
+// do sends a request to the fleet server, and turns bad status codes into errors.
+func (f *httpFleet) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	return f.send(ctx, f.client, method, path, body)
+}
+
+func (f *httpFleet) send(ctx context.Context, client *http.Client, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, f.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+
 	req.Header.Set("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(req)
+	if f.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.conf.Token)
+	} else if f.conf.Username != "" {
+		req.SetBasicAuth(f.conf.Username, f.conf.Password)
+	}
+
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	if res.StatusCode >= 300 {
+		defer res.Body.Close()
 		b := bytes.NewBuffer([]byte{})
 		b.ReadFrom(res.Body)
-		return nil, fmt.Errorf("encountered bad HTTP status code %d - %s", res.StatusCode, b.String())
-	}
+		err := fmt.Errorf("encountered bad HTTP status code %d - %s", res.StatusCode, b.String())
+		if isClientStatus(res.StatusCode) {
+			return nil, &ClientError{err}
+		}
 
-	robots := []*fleet.Robot{}
-	bodyBytes, _ := ioutil.ReadAll(res.Body)
-	err = json.Unmarshal(bodyBytes, &robots)
-	if err != nil {
 		return nil, err
 	}
 
-	return robots, nil
+	return res, nil
+}
+
+// isClientStatus tells whether the fleet manager refused a request for a reason that sending it
+// again would not change. Timeouts and rate limits are worth another try.
+func isClientStatus(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
 }
@@ -0,0 +1,76 @@
+package global
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"wf-engine/fleet"
+)
+
+// NewInProcessFleet returns a FleetAdapter that drives store directly, without going through the
+// fleet server. It is mostly useful for tests.
+func NewInProcessFleet(store *fleet.Store) FleetAdapter {
+	return &inProcessFleet{store: store}
+}
+
+type inProcessFleet struct {
+	store *fleet.Store
+}
+
+func (f *inProcessFleet) ListRobots(ctx context.Context) ([]*fleet.Robot, error) {
+	return f.store.GetRobots(), nil
+}
+
+func (f *inProcessFleet) SendToPose(ctx context.Context, robot string, pose fleet.Pose) error {
+	// The store only fails to send a robot when it refuses the mission, unless the robot is
+	// offline and may come back.
+	_, err := f.store.Send(robot, pose, "")
+	if err != nil && !errors.Is(err, fleet.ErrRobotOffline) {
+		return &ClientError{err}
+	}
+
+	return err
+}
+
+func (f *inProcessFleet) CancelMission(ctx context.Context, robot string) error {
+	if f.store.GetRobot(robot) == nil {
+		return &ClientError{fmt.Errorf("robot %s does not exist", robot)}
+	}
+
+	if f.store.CancelMission(robot) == nil {
+		return &ClientError{fmt.Errorf("robot %s has no mission in progress", robot)}
+	}
+
+	return nil
+}
+
+func (f *inProcessFleet) Subscribe(ctx context.Context) (<-chan []*fleet.Robot, error) {
+	changes, unsubscribe := f.store.Subscribe()
+	updates := make(chan []*fleet.Robot)
+	go func() {
+		defer close(updates)
+		defer unsubscribe()
+
+		robots := f.store.GetRobots()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case updates <- robots:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case robot, ok := <-changes:
+				if !ok {
+					return
+				}
+
+				robots = []*fleet.Robot{&robot}
+			}
+		}
+	}()
+
+	return updates, nil
+}
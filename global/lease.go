@@ -0,0 +1,262 @@
+package global
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+	"wf-engine/fleet"
+)
+
+// Lease reserves a robot for a single owner, usually a node of a run, until it expires. Only the
+// owner of a lease may send its robot on a mission.
+type Lease struct {
+	Robot   string
+	Owner   string
+	Expires time.Time
+}
+
+type leaseOp int
+
+const (
+	acquireLease leaseOp = iota
+	acquireAnyLease
+	renewLease
+	releaseLease
+)
+
+type leaseRequest struct {
+	// ctx is set when the request waits for the lease to be acquired.
+	ctx      context.Context
+	op       leaseOp
+	robot    string
+	owner    string
+	status   string
+	ttl      time.Duration
+	response chan leaseResponse
+
+	// pick narrows down the robots of acquireAnyLease.
+	pick Pick
+}
+
+// Pick narrows down the robots that AcquireAnyLease picks from.
+type Pick struct {
+	// Candidates are the robots to pick from, every robot is a candidate when it is nil.
+	Candidates []string
+
+	// Near picks the robot nearest to it when it is set, the first by name otherwise.
+	Near *fleet.Pose
+
+	// MinBattery leaves out robots with less battery, in percent.
+	MinBattery float64
+}
+
+type leaseResponse struct {
+	lease *Lease
+	err   error
+}
+
+// AcquireLease reserves robot for owner during ttl. It fails when the robot does not exist, is
+// leased by another owner, is not in status (unless status is empty), or has not been read from
+// the fleet since its last lease was released, as its state may not reflect the last mission yet.
+// Releasing a lease has robots polled straight away, so that it does not take long. Acquiring a
+// lease that owner already holds renews it.
+func (s *state) AcquireLease(robot, owner, status string, ttl time.Duration) (*Lease, error) {
+	return s.requestLease(leaseRequest{op: acquireLease, robot: robot, owner: owner, status: status, ttl: ttl})
+}
+
+// AcquireAnyLease reserves one of the robots narrowed down by pick for owner during ttl, under the
+// same conditions as AcquireLease.
+func (s *state) AcquireAnyLease(pick Pick, owner, status string, ttl time.Duration) (*Lease, error) {
+	return s.requestLease(leaseRequest{op: acquireAnyLease, owner: owner, status: status, ttl: ttl, pick: pick})
+}
+
+// WaitForLease blocks until AcquireLease succeeds, trying again every time robots or leases change,
+// or until ctx is done.
+func (s *state) WaitForLease(ctx context.Context, robot, owner, status string, ttl time.Duration) (*Lease, error) {
+	return s.requestLease(leaseRequest{ctx: ctx, op: acquireLease, robot: robot, owner: owner, status: status, ttl: ttl})
+}
+
+// WaitForAnyLease blocks until AcquireAnyLease succeeds, trying again every time robots or leases
+// change, or until ctx is done.
+func (s *state) WaitForAnyLease(ctx context.Context, pick Pick, owner, status string, ttl time.Duration) (*Lease, error) {
+	return s.requestLease(leaseRequest{ctx: ctx, op: acquireAnyLease, owner: owner, status: status, ttl: ttl, pick: pick})
+}
+
+// RenewLease extends a lease held by owner by ttl from now. It fails when the lease has expired.
+func (s *state) RenewLease(robot, owner string, ttl time.Duration) (*Lease, error) {
+	return s.requestLease(leaseRequest{op: renewLease, robot: robot, owner: owner, ttl: ttl})
+}
+
+// ReleaseLease gives back a robot leased by owner.
+func (s *state) ReleaseLease(robot, owner string) error {
+	_, err := s.requestLease(leaseRequest{op: releaseLease, robot: robot, owner: owner})
+	return err
+}
+
+func (s *state) requestLease(req leaseRequest) (*Lease, error) {
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// The response is buffered so that a request that is given up on never blocks global state.
+	req.response = make(chan leaseResponse, 1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case s.leaseRequests <- req:
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-req.response:
+		return res.lease, res.err
+	}
+}
+
+func (s *state) handleLeaseRequest(req leaseRequest) {
+	lease, err := s.lease(req)
+	if err != nil && req.ctx != nil {
+		s.wait(req.ctx, func() bool {
+			lease, err := s.lease(req)
+			if err != nil {
+				return false
+			}
+
+			req.response <- leaseResponse{lease: lease}
+			return true
+		})
+
+		return
+	}
+
+	req.response <- leaseResponse{lease: lease, err: err}
+	if req.op == releaseLease && err == nil {
+		s.wake()
+	}
+}
+
+func (s *state) lease(req leaseRequest) (*Lease, error) {
+	s.expireLeases()
+
+	now := time.Now()
+	lease, leased := s.leases[req.robot]
+	held := leased && lease.Owner == req.owner
+
+	switch req.op {
+	case acquireLease:
+		if err := s.leasable(req.robot, req.owner, req.status); err != nil {
+			return nil, err
+		}
+	case acquireAnyLease:
+		robot, err := s.pick(req)
+		if err != nil {
+			return nil, err
+		}
+
+		req.robot = robot
+	case renewLease:
+		if !held {
+			return nil, fmt.Errorf("robot %s is not leased by %s", req.robot, req.owner)
+		}
+	case releaseLease:
+		if !held {
+			return nil, fmt.Errorf("robot %s is not leased by %s", req.robot, req.owner)
+		}
+
+		s.release(req.robot, now)
+		return nil, nil
+	}
+
+	lease = &Lease{Robot: req.robot, Owner: req.owner, Expires: now.Add(req.ttl)}
+	s.leases[req.robot] = lease
+
+	copy := *lease
+	return &copy, nil
+}
+
+// expireLeases drops every lease that has not been renewed in time. It reports whether any did.
+func (s *state) expireLeases() bool {
+	now := time.Now()
+	expired := false
+	for name, lease := range s.leases {
+		if now.After(lease.Expires) {
+			s.release(name, now)
+			expired = true
+		}
+	}
+
+	return expired
+}
+
+// release gives back the lease of a robot at now. The robot may have changed without the fleet
+// saying so yet, so robots are polled to refresh it.
+func (s *state) release(name string, now time.Time) {
+	delete(s.leases, name)
+	s.released[name] = now
+	s.requestRefresh()
+}
+
+// leasable reports why robot cannot be leased to owner, if it cannot.
+func (s *state) leasable(name, owner, status string) error {
+	_, ok := s.robots[name]
+	lease, leased := s.leases[name]
+	held := leased && lease.Owner == owner
+
+	switch {
+	case !ok:
+		return fmt.Errorf("robot %s does not exist", name)
+	case leased && !held:
+		return fmt.Errorf("robot %s is leased by %s", name, lease.Owner)
+	case !held && !s.updated[name].After(s.released[name]):
+		return fmt.Errorf("robot %s has not been refreshed since its last lease", name)
+	case status != "" && s.status(name) != status:
+		return fmt.Errorf("robot %s is %s", name, s.status(name))
+	}
+
+	return nil
+}
+
+// pick returns the candidate of req that is to be leased.
+func (s *state) pick(req leaseRequest) (string, error) {
+	candidates := req.pick.Candidates
+	if candidates == nil {
+		for name := range s.robots {
+			candidates = append(candidates, name)
+		}
+	}
+
+	available := []string{}
+	for _, name := range candidates {
+		if s.leasable(name, req.owner, req.status) == nil && s.robots[name].Battery >= req.pick.MinBattery {
+			available = append(available, name)
+		}
+	}
+
+	if len(available) == 0 {
+		return "", fmt.Errorf("none of %d robots can be leased", len(candidates))
+	}
+
+	near := req.pick.Near
+	distance := func(name string) float64 {
+		if near == nil {
+			return 0
+		}
+
+		pose := s.robots[name].CurrentPose
+		return math.Hypot(pose.X-near.X, pose.Y-near.Y)
+	}
+
+	sort.Slice(available, func(i, j int) bool {
+		if di, dj := distance(available[i]), distance(available[j]); di != dj {
+			return di < dj
+		}
+
+		return available[i] < available[j]
+	})
+
+	return available[0], nil
+}
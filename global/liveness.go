@@ -0,0 +1,105 @@
+package global
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Statuses that global state reports in place of the status of a robot that the fleet has not
+// reported in a while.
+const (
+	// StatusStale means that the robot has not been seen for global.stale_after, so the rest of
+	// its state may be out of date.
+	StatusStale = "STALE"
+
+	// StatusOffline means that the robot has not been seen for global.offline_after, and cannot
+	// be relied on until it is seen again.
+	StatusOffline = "OFFLINE"
+)
+
+// Liveness says how long a robot may go unseen before it is reported as STALE or OFFLINE, and how
+// long to wait before a broken robot stream is opened again. Zero durations fall back to
+// global.stale_after, global.offline_after and global.reconnect_intv from the config.
+type Liveness struct {
+	StaleAfter    time.Duration
+	OfflineAfter  time.Duration
+	ReconnectIntv time.Duration
+}
+
+// SetLiveness overrides the liveness settings of the config with l. Unlike the config, it may be
+// changed while global state is active. It returns the function that puts the previous settings
+// back.
+func (s *state) SetLiveness(l Liveness) func() {
+	previous := s.override.Swap(l)
+	return func() {
+		s.override.Store(previous)
+	}
+}
+
+// livenessSettings returns the liveness settings, from the config unless they are overridden.
+func (s *state) livenessSettings() Liveness {
+	l := s.override.Load().(Liveness)
+	if l.StaleAfter == 0 {
+		l.StaleAfter = viper.GetDuration("global.stale_after")
+	}
+
+	if l.OfflineAfter == 0 {
+		l.OfflineAfter = viper.GetDuration("global.offline_after")
+	}
+
+	if l.ReconnectIntv == 0 {
+		l.ReconnectIntv = viper.GetDuration("global.reconnect_intv")
+	}
+
+	return l
+}
+
+// status returns the status of a robot, as reported to jobs and leases.
+func (s *state) status(name string) string {
+	if status, ok := s.liveness[name]; ok {
+		return status
+	}
+
+	return s.robots[name].Status
+}
+
+// checkLiveness marks the robots that have not been seen in a while as stale or offline. While
+// robots are streamed, every robot the fleet has sent is seen, as the fleet pushes any change. It
+// reports whether the status of any robot changed.
+func (s *state) checkLiveness(now time.Time) bool {
+	settings := s.livenessSettings()
+	staleAfter, offlineAfter := settings.StaleAfter, settings.OfflineAfter
+
+	changed := false
+	for name := range s.robots {
+		if s.Streaming() && s.present[name] {
+			s.seen[name] = now
+		}
+
+		age := now.Sub(s.seen[name])
+		status := ""
+		switch {
+		case offlineAfter > 0 && age >= offlineAfter:
+			status = StatusOffline
+		case staleAfter > 0 && age >= staleAfter:
+			status = StatusStale
+		}
+
+		if status == s.liveness[name] {
+			continue
+		}
+
+		changed = true
+		if status == "" {
+			delete(s.liveness, name)
+			continue
+		}
+
+		log.Warnf("robot %s is %s, it was last seen %s ago", name, status, age.Round(time.Millisecond))
+		s.liveness[name] = status
+	}
+
+	return changed
+}
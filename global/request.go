@@ -1,6 +1,9 @@
 package global
 
-import "wf-engine/fleet"
+import (
+	"time"
+	"wf-engine/fleet"
+)
 
 // RobotReqquest is request for robot from global state.
 type RobotReqquest struct {
@@ -9,7 +12,17 @@ type RobotReqquest struct {
 	Response chan *fleet.Robot
 }
 
+// RobotListRequest is request for a copy of every robot in global state.
+type RobotListRequest struct {
+	Response chan []*fleet.Robot
+}
+
 type stateUpdate struct {
+	// at is when robots were fetched, which is when they are known to be up to date.
+	at     time.Time
 	robots []*fleet.Robot
 	done   chan struct{}
+
+	// full is set when robots are every robot of the fleet, so that those missing have left it.
+	full bool
 }
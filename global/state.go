@@ -2,6 +2,8 @@ package global
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
 	"time"
 	"wf-engine/fleet"
 
@@ -15,26 +17,78 @@ var State *state
 func init() {
 	State = &state{
 		GetRobotByStatus: make(chan RobotReqquest),
+		GetRobots:        make(chan RobotListRequest),
 		update:           make(chan stateUpdate),
 		robots:           make(map[string]*fleet.Robot),
+		updated:          make(map[string]time.Time),
+		seen:             make(map[string]time.Time),
+		present:          make(map[string]bool),
+		liveness:         make(map[string]string),
+		leaseRequests:    make(chan leaseRequest),
+		leases:           make(map[string]*Lease),
+		released:         make(map[string]time.Time),
+		waitRequests:     make(chan waitRequest),
+		refresh:          make(chan struct{}, 1),
+		override:         &atomic.Value{},
 	}
+
+	State.override.Store(Liveness{})
 }
 
 type state struct {
 	GetRobotByStatus chan RobotReqquest
+	GetRobots        chan RobotListRequest
 	update           chan stateUpdate
 	robots           map[string]*fleet.Robot
+
+	// updated is when the state of each robot was last read from the fleet, and seen when the
+	// robot was last known to be alive. present is set for the robots of the last full update, and
+	// liveness holds StatusStale or StatusOffline for robots that have not been seen in a while.
+	updated  map[string]time.Time
+	seen     map[string]time.Time
+	present  map[string]bool
+	liveness map[string]string
+
+	leaseRequests chan leaseRequest
+	leases        map[string]*Lease
+	released      map[string]time.Time
+
+	waitRequests chan waitRequest
+	waiters      []*waiter
+
+	// streaming is set while robots are pushed by the fleet server, and polling is paused.
+	streaming int32
+
+	// refresh asks for robots to be polled straight away, even while they are streamed.
+	refresh chan struct{}
+
+	// override holds the Liveness settings that take precedence over the config.
+	override *atomic.Value
 }
 
 func (s *state) Activate(ctx context.Context, updateDone chan struct{}) {
 	go s.pollRobots(ctx)
+	if viper.GetBool("global.stream") {
+		go s.streamRobots(ctx)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-ticker.C:
+			s.expire()
+		case req := <-s.waitRequests:
+			s.handleWaitRequest(req)
 		case req := <-s.GetRobotByStatus:
 			s.handleRobotRequest(req)
+		case req := <-s.GetRobots:
+			s.handleRobotListRequest(req)
+		case req := <-s.leaseRequests:
+			s.handleLeaseRequest(req)
 		case update := <-s.update:
 			s.handleUpdate(update)
 			select {
@@ -45,45 +99,165 @@ func (s *state) Activate(ctx context.Context, updateDone chan struct{}) {
 	}
 }
 
+// pollRobots polls robots every global.polling_intv while they are not streamed, and whenever a
+// refresh is requested.
 func (s *state) pollRobots(ctx context.Context) {
 	ticker := time.NewTicker(viper.GetDuration("global.polling_intv"))
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			robots, err := httpFetchRobotList()
-			if err != nil {
-				log.Error(err)
+			if s.Streaming() {
 				continue
 			}
+		case <-s.refresh:
+		}
 
-			done := make(chan struct{})
-			s.update <- stateUpdate{robots: robots, done: done}
-			<-done
+		at := time.Now()
+		robots, err := Fleet().ListRobots(ctx)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		if !s.apply(ctx, stateUpdate{at: at, robots: robots, full: true}) {
+			return
 		}
 	}
 }
 
+// requestRefresh has robots polled straight away, unless a poll is already pending.
+func (s *state) requestRefresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Streaming reports whether robots are pushed by the fleet server, in which case global state
+// is always up to date and polling is paused. Otherwise it is refreshed every
+// global.polling_intv.
+func (s *state) Streaming() bool {
+	return atomic.LoadInt32(&s.streaming) == 1
+}
+
+// streamRobots keeps a subscription to robot changes open with the fleet, and subscribes again
+// every global.reconnect_intv when it breaks. Robots are polled in the meantime.
+func (s *state) streamRobots(ctx context.Context) {
+	for {
+		err := s.readRobotStream(ctx)
+		atomic.StoreInt32(&s.streaming, 0)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Warnf("robot stream is unavailable, polling robots instead: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.livenessSettings().ReconnectIntv):
+		}
+	}
+}
+
+// readRobotStream applies every robot received from the fleet until the stream breaks. Polling is
+// paused once the stream has caught up with the fleet.
+func (s *state) readRobotStream(ctx context.Context) error {
+	updates, err := Fleet().Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+
+	full := true
+	for robots := range updates {
+		if !s.apply(ctx, stateUpdate{at: time.Now(), robots: robots, full: full}) {
+			return ctx.Err()
+		}
+
+		full = false
+		atomic.StoreInt32(&s.streaming, 1)
+	}
+
+	return errors.New("robot stream was closed by the fleet")
+}
+
+// apply hands an update over to the goroutine that owns global state. It returns false when ctx
+// is done before it is applied.
+func (s *state) apply(ctx context.Context, update stateUpdate) bool {
+	update.done = make(chan struct{})
+	select {
+	case <-ctx.Done():
+		return false
+	case s.update <- update:
+	}
+
+	<-update.done
+	return true
+}
+
 func (s *state) handleRobotRequest(req RobotReqquest) {
 	if _, ok := s.robots[req.Robot]; !ok {
 		req.Response <- nil
 		return
 	}
 
-	if s.robots[req.Robot].Status != req.Status {
+	if s.status(req.Robot) != req.Status {
 		req.Response <- nil
 		return
 	}
 
-	copy := *s.robots[req.Robot]
-	req.Response <- &copy
+	req.Response <- s.copyRobot(req.Robot)
+}
+
+func (s *state) handleRobotListRequest(req RobotListRequest) {
+	req.Response <- s.copyRobots()
+}
+
+func (s *state) copyRobots() []*fleet.Robot {
+	robots := make([]*fleet.Robot, 0, len(s.robots))
+	for name := range s.robots {
+		robots = append(robots, s.copyRobot(name))
+	}
+
+	return robots
+}
+
+// copyRobot returns a copy of a robot in global state, with its status replaced by StatusStale or
+// StatusOffline when it has not been seen in a while.
+func (s *state) copyRobot(name string) *fleet.Robot {
+	copy := *s.robots[name]
+	copy.Status = s.status(name)
+	return &copy
 }
 
 func (s *state) handleUpdate(update stateUpdate) {
+	if update.full {
+		s.present = make(map[string]bool)
+	}
+
 	for _, robot := range update.robots {
+		s.present[robot.Name] = true
+		if s.seen[robot.Name].Before(update.at) {
+			s.seen[robot.Name] = update.at
+		}
+
+		if status, ok := s.liveness[robot.Name]; ok {
+			log.Infof("robot %s is back after being %s", robot.Name, status)
+			delete(s.liveness, robot.Name)
+		}
+
+		// A poll that started before the last change to a robot was streamed is out of date.
+		if s.updated[robot.Name].After(update.at) {
+			continue
+		}
+
 		s.robots[robot.Name] = robot
+		s.updated[robot.Name] = update.at
 	}
 
+	s.wake()
 	update.done <- struct{}{}
 }
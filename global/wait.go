@@ -0,0 +1,84 @@
+package global
+
+import (
+	"context"
+	"time"
+	"wf-engine/fleet"
+)
+
+// waiter is retried by global state every time something changes, until it succeeds or its
+// context is done.
+type waiter struct {
+	ctx context.Context
+	try func() bool
+}
+
+type waitRequest struct {
+	ctx       context.Context
+	predicate func([]*fleet.Robot) bool
+	response  chan []*fleet.Robot
+}
+
+// WaitFor blocks until the robots in global state satisfy predicate, and returns the robots that
+// did. The predicate is evaluated straight away, then every time robots are updated, so callers
+// react to changes as soon as global state learns about them. It returns early when ctx is done.
+func (s *state) WaitFor(ctx context.Context, predicate func([]*fleet.Robot) bool) ([]*fleet.Robot, error) {
+	// The response is buffered so that a wait that is given up on never blocks global state.
+	req := waitRequest{ctx: ctx, predicate: predicate, response: make(chan []*fleet.Robot, 1)}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case s.waitRequests <- req:
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case robots := <-req.response:
+		return robots, nil
+	}
+}
+
+func (s *state) handleWaitRequest(req waitRequest) {
+	s.wait(req.ctx, func() bool {
+		robots := s.copyRobots()
+		if !req.predicate(robots) {
+			return false
+		}
+
+		req.response <- robots
+		return true
+	})
+}
+
+// wait tries w straight away, and keeps it around to be tried again until it succeeds.
+func (s *state) wait(ctx context.Context, try func() bool) {
+	if !try() {
+		s.waiters = append(s.waiters, &waiter{ctx: ctx, try: try})
+	}
+}
+
+// wake tries every waiter again, and forgets those that succeed or are no longer waited on.
+func (s *state) wake() {
+	waiters := s.waiters[:0]
+	for _, w := range s.waiters {
+		if w.ctx.Err() == nil && !w.try() {
+			waiters = append(waiters, w)
+		}
+	}
+
+	for i := len(waiters); i < len(s.waiters); i++ {
+		s.waiters[i] = nil
+	}
+	s.waiters = waiters
+}
+
+// expire drops leases that have not been renewed in time and marks robots that have not been
+// seen in a while, which nothing else reports, and wakes up waiters when anything changed.
+func (s *state) expire() {
+	expired := s.expireLeases()
+	changed := s.checkLiveness(time.Now())
+	if expired || changed {
+		s.wake()
+	}
+}
@@ -2,9 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"wf-engine/cmd"
 	"wf-engine/fleet"
 	"wf-engine/global"
 	wf "wf-engine/workflow"
@@ -27,41 +40,1832 @@ func init() {
 	viper.SetConfigType("toml")
 }
 
-func TestWorkflow(t *testing.T) {
-	if err := viper.ReadInConfig(); err != nil {
-		t.Error(err)
-		return
+// testFleet drives the mock fleet in process, and can cut global state off from it.
+var testFleet = &cuttableFleet{FleetAdapter: global.NewInProcessFleet(fleet.Default()), mutex: &sync.Mutex{}}
+
+// cuttableFleet lets tests cut global state off from the fleet, as if the network went down. Robots
+// carry on with their missions in the meantime.
+type cuttableFleet struct {
+	global.FleetAdapter
+
+	mutex   *sync.Mutex
+	down    bool
+	streams []context.CancelFunc
+
+	// polls counts the robots lists that were asked for.
+	polls int
+}
+
+// cut breaks every robot stream, and fails every request for robots until restore is called.
+func (f *cuttableFleet) cut() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.down = true
+	for _, cancel := range f.streams {
+		cancel()
 	}
+	f.streams = nil
+}
 
-	testserver := httptest.NewServer(fleet.LoadRoutes())
-	defer testserver.Close()
+func (f *cuttableFleet) restore() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	f.down = false
+}
+
+func (f *cuttableFleet) ListRobots(ctx context.Context) ([]*fleet.Robot, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.polls++
+	if f.down {
+		return nil, errors.New("fleet is unreachable")
+	}
+
+	return f.FleetAdapter.ListRobots(ctx)
+}
+
+func (f *cuttableFleet) Subscribe(ctx context.Context) (<-chan []*fleet.Robot, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.down {
+		return nil, errors.New("fleet is unreachable")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	f.streams = append(f.streams, cancel)
+	return f.FleetAdapter.Subscribe(ctx)
+}
 
+// TestMain drives the mock fleet in process and keeps global state in sync with it for every test.
+func TestMain(m *testing.M) {
 	if err := viper.ReadInConfig(); err != nil {
-		t.Error(err)
-		return
+		log.Fatal(err)
 	}
 
-	viper.Set("http.port", strings.Split(testserver.URL, ":")[2])
+	global.UseFleet(testFleet)
+	ctx, cancel := context.WithCancel(context.Background())
 
 	// Make sure global state can poll robots correctly before starting workflow
 	done := make(chan struct{})
 	go global.State.Activate(ctx, done)
 	<-done
 
+	code := m.Run()
+	cancel()
+	os.Exit(code)
+}
+
+func TestWorkflow(t *testing.T) {
+	resetRobots(t)
 	root := wf.NewRoot("start")
-	A := wf.NewJob([]wf.Node{root}, "navigate to (10, 10)", "freight1")
-	B := wf.NewJob([]wf.Node{root}, "navigate to (10, 10)", "freight2")
-	C := wf.NewJob([]wf.Node{A, B}, "navigate to (10, 10)", "freight3")
+	A := wf.NewJob([]wf.Node{root}, "navigate to (10, 10)", "freight1", wf.NavigateTo(10, 10))
+	B := wf.NewJob([]wf.Node{root}, "navigate to (10, 10)", "freight2", wf.NavigateTo(10, 10))
+	C := wf.NewJob([]wf.Node{A, B}, "navigate to (10, 10)", "freight3", wf.NavigateTo(10, 10))
 	wf.NewTerminal([]wf.Node{C}, "all robots have started moving")
 
-	D := wf.NewConditional([]wf.Node{C}, "are all robots at (10, 10)?")
-	wf.NewTerminal([]wf.Node{D}, "all robots have reached (10, 10)")
+	D := wf.NewConditional([]wf.Node{C}, "are all robots at (10, 10)?", nil)
+	E := wf.NewTerminal([]wf.Node{D}, "all robots have reached (10, 10)")
+	F := wf.NewTerminal([]wf.Node{D}, "some robots have not reached (10, 10)")
+	if err := D.(*wf.Conditional).Else(F); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := wf.Run(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := result.Get(C); res.State != wf.StateSucceeded || res.Robot != "freight3" || res.Start.IsZero() || res.End.Before(res.Start) {
+		t.Errorf("unexpected result for %q: %+v", C.Name(), res)
+	}
+
+	if result.Count(wf.StateSucceeded) != len(result.Nodes)-1 || result.Nodes[0].Name != "start" {
+		t.Errorf("unexpected timeline:\n%s", result)
+	}
+
+	// Jobs do not wait for their robots, which are still on their way when the conditional runs.
+	if E.State() != wf.StateSkipped || F.State() != wf.StateSucceeded {
+		t.Errorf("expected %q to be skipped and %q to succeed, got %s and %s", E.Name(), F.Name(), E.State(), F.State())
+	}
+
+	if dot := wf.DOT(root, true); !strings.Contains(dot, `label="start", shape=oval, style=filled, fillcolor="#98df8a"`) {
+		t.Errorf("expected succeeded root in exported graph:\n%s", dot)
+	}
+}
+
+func TestConditionalJoins(t *testing.T) {
+	never := func(wf.Snapshot) bool { return false }
+
+	root := wf.NewRoot("start")
+	D := wf.NewConditional([]wf.Node{root}, "never", never)
+	then := wf.NewJob([]wf.Node{D}, "send freight1", "freight1", wf.NavigateTo(10, 10))
+	deeper := wf.NewConditional([]wf.Node{then}, "after freight1", wf.TruthyCondition)
+	deepest := wf.NewTerminal([]wf.Node{deeper}, "after after freight1")
+	otherwise := wf.NewConditional([]wf.Node{D}, "otherwise", wf.TruthyCondition)
+	if err := D.(*wf.Conditional).Else(otherwise); err != nil {
+		t.Fatal(err)
+	}
+
+	outside := wf.NewConditional([]wf.Node{root}, "outside", wf.TruthyCondition)
+	both := wf.NewTerminal([]wf.Node{then, otherwise}, "both branches")
+	mixed := wf.NewTerminal([]wf.Node{deeper, outside}, "skipped branch and outside")
+
+	result, err := wf.Run(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[wf.Node]wf.State{
+		then:      wf.StateSkipped,
+		deeper:    wf.StateSkipped,
+		deepest:   wf.StateSkipped,
+		otherwise: wf.StateSucceeded,
+		both:      wf.StateSucceeded,
+		mixed:     wf.StateSucceeded,
+	}
+
+	for n, state := range expected {
+		if res := result.Get(n); res.State != state {
+			t.Errorf("expected %q to be %s, got %s", n.Name(), state, res.State)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with the content of testdata/name, or rewrites it when -update is set.
+func golden(t *testing.T, name string, got string) {
+	t.Helper()
+
+	filename := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(filename, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != string(expected) {
+		t.Errorf("output does not match %s, got:\n%s", filename, got)
+	}
+}
+
+// runCommand runs the program with args and returns what it printed to stdout.
+func runCommand(t *testing.T, args ...string) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	stdout, argv := os.Stdout, os.Args
+	os.Stdout, os.Args = w, append([]string{"wf-engine"}, args...)
+	defer func() { os.Stdout, os.Args = stdout, argv }()
+
+	output := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		output <- b
+	}()
+
+	cmd.Execute()
+	w.Close()
+	return string(<-output)
+}
+
+func TestExport(t *testing.T) {
+	f, err := os.Open("conf/workflow.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	root, err := wf.Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every node type and both branches of a conditional, without states
+	golden(t, "workflow.dot", wf.DOT(root, false))
+	golden(t, "workflow.mmd", wf.Mermaid(root, false))
+
+	// The graph command prints the same graph
+	golden(t, "workflow.dot", runCommand(t, "graph", "--file", "conf/workflow.yaml"))
+	golden(t, "workflow.mmd", runCommand(t, "graph", "--file", "conf/workflow.yaml", "--format", "mermaid"))
+
+	// --export writes the graph colored by the state every node ended in
+	never := func(wf.Snapshot) bool { return false }
+
+	root = wf.NewRoot("start")
+	D := wf.NewConditional([]wf.Node{root}, "never", never)
+	then := wf.NewJob([]wf.Node{D}, `send "freight1"`, "freight1", wf.NavigateTo(10, 10))
+	wf.NewTerminal([]wf.Node{then}, "after freight1")
+	otherwise := wf.NewTerminal([]wf.Node{D}, "otherwise")
+	if err := D.(*wf.Conditional).Else(otherwise); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := wf.Run(root); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"export.dot", "export.mmd"} {
+		filename := filepath.Join(dir, name)
+		if err := wf.Export(root, filename); err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		golden(t, name, string(content))
+	}
+}
+
+func TestLoadWorkflow(t *testing.T) {
+	f, err := os.Open("conf/workflow.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	root, err := wf.Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root.Name() != "root" || len(root.Children()) != 3 {
+		t.Errorf("unexpected root %q with %d children", root.Name(), len(root.Children()))
+	}
+
+	cases := map[string]string{
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: job, device: freight1,\n     action: {target: {x: 1, y: 1}}, dependencies: [c]}\n":                                         `line 4: node "b" depends on unknown node "c"`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: a, type: terminal, dependencies: [a]}\n":                                                                                            `line 3: node "a" is already declared on line 2`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: job, device: freight1, allocate: {nearest: true},\n     action: {target: {x: 1, y: 1}}, dependencies: [a]}\n":              `line 3: node "b" is a job and cannot both specify a device and allocate a robot`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: job, device: freight1, on_offline: wait,\n     action: {target: {x: 1, y: 1}}, dependencies: [a]}\n":                       `line 3: node "b" has unknown offline policy "wait"`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: job, allocate: {min_battery: 120},\n     action: {target: {x: 1, y: 1}}, dependencies: [a]}\n":                             `line 3: node "b" requires a battery level of 120%, which is not between 0 and 100`,
+		`{"nodes": [{"name": "a", "type": "root"}, {"name": "b", "type": "loop", "dependencies": ["a"]}]}`:                                                                                 `line 1: node "b" has unknown type "loop"`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: conditional, timeout: 1s, dependencies: [a]}\n":                                                                            `line 3: node "b" is not a job and cannot have a timeout, a retry policy or an offline policy`,
+		"nodes:\n  - {name: a, type: root}\n  - name: b\n    type: terminal\n    dependecies: [a]\n":                                                                                       `line 5: node "b" has unknown field "dependecies"`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: job, device: freight1, retry: {max_attemps: 3},\n     action: {target: {x: 1, y: 1}}, dependencies: [a]}\n":                `line 3: node "b" has unknown field "max_attemps"`,
+		"nodes:\n  - {name: a, type: root}\n  - name: b\n    type: conditional\n    condition:\n      not: {status_is: {robot: freight1, state: IDLE}}\n    dependencies: [a]\n":           `line 6: node "b" has unknown field "state"`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: job, device: freight1, timeout: -1s,\n     action: {target: {x: 1, y: 1}}, dependencies: [a]}\n":                           `line 3: node "b" has a negative timeout -1s`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: job, device: freight1, retry: {max_attempts: -1},\n     action: {target: {x: 1, y: 1}}, dependencies: [a]}\n":              `line 3: node "b" has a negative number of attempts -1`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: job, device: freight1, retry: {max_attempts: 3, backoff: -1s},\n     action: {target: {x: 1, y: 1}}, dependencies: [a]}\n": `line 3: node "b" has a negative backoff -1s`,
+		"nodes:\n  - {name: a, type: root}\n  - {name: b, type: conditional, dependencies: [a],\n     condition: {variable_is: {name: x, value: y}}, else: [c]}\n":                         `line 4: node "b" has unknown node "c" on its else branch`,
+	}
+
+	for doc, expected := range cases {
+		_, err := wf.Load(strings.NewReader(doc))
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestValidateWorkflow(t *testing.T) {
+	root := wf.NewRoot("start")
+	A := wf.NewJob([]wf.Node{root}, "A", "freight1", wf.NavigateTo(1, 1), wf.OnOffline("pasue"))
+	B := wf.NewJob([]wf.Node{A}, "B", "", wf.NavigateTo(1, 1))
+	wf.NewTerminal([]wf.Node{B}, "end")
+
+	orphan := wf.NewJob([]wf.Node{}, "orphan", "freight2", wf.NavigateTo(2, 2))
+	C := wf.NewJob([]wf.Node{A, orphan}, "C", "freight3", wf.NavigateTo(3, 3))
+	D := wf.NewJob([]wf.Node{C}, "D", "freight3", wf.Action{Type: "dance"})
+	C.AddParent(D)
+	D.AddChild(C)
+
+	expected := map[string]bool{
+		`node "A" has unknown offline policy "pasue"`:                true,
+		`node "B" is a job without a device`:                         true,
+		`node "D" has unknown action type "dance"`:                   true,
+		`node "orphan" is an orphan, it does not depend on any node`: true,
+		`node "C" is part of a cycle "C" -> "D" -> "C"`:              true,
+	}
+
+	errs := wf.Validate(root)
+	for _, err := range errs {
+		if !expected[err.Error()] {
+			t.Errorf("unexpected validation error %v", err)
+		}
+		delete(expected, err.Error())
+	}
+
+	for msg := range expected {
+		t.Errorf("expected validation error %s", msg)
+	}
+
+	if _, err := wf.Run(root); err == nil {
+		t.Error("expected Run to refuse an invalid graph")
+	}
+}
+
+func TestConditions(t *testing.T) {
+	snapshot := wf.Snapshot{
+		Robots: map[string]fleet.Robot{
+			"freight1": {Name: "freight1", Status: "IDLE", CurrentPose: fleet.Pose{X: 10, Y: 10.3}, Battery: 42},
+			"freight2": {Name: "freight2", Status: "WORKING", CurrentPose: fleet.Pose{X: 4, Y: 2}},
+			"freight3": {Name: "freight3", Status: "IDLE", CurrentPose: fleet.Pose{X: 0, Y: 0}},
+		},
+		Variables: map[string]string{"zone": "A"},
+	}
+
+	cases := map[string]struct {
+		cond     wf.Condition
+		expected bool
+	}{
+		"within tolerance":  {wf.AtPose("freight1", fleet.Pose{X: 10, Y: 10}, 0.5), true},
+		"outside tolerance": {wf.AtPose("freight1", fleet.Pose{X: 10, Y: 10}, 0.1), false},
+		"unknown robot":     {wf.StatusIs("freight9", "IDLE"), false},
+		"two robots idle":   {wf.CountStatus("IDLE", 2), true},
+		"enough battery":    {wf.BatteryAbove("freight1", 40), true},
+		"low battery":       {wf.BatteryAbove("freight1", 50), false},
+		"combinators":       {wf.All(wf.VariableIs("zone", "A"), wf.Any(wf.StatusIs("freight2", "IDLE"), wf.Not(wf.StatusIs("freight3", "WORKING")))), true},
+	}
+
+	for name, c := range cases {
+		if c.cond(snapshot) != c.expected {
+			t.Errorf("%s: expected %v", name, c.expected)
+		}
+	}
+}
+
+// fetchRobot reads a robot straight from the mock fleet.
+func fetchRobot(t *testing.T, name string) fleet.Robot {
+	robot := fleet.Default().GetRobot(name)
+	if robot == nil {
+		t.Fatalf("robot %s does not exist", name)
+	}
+
+	return *robot
+}
+
+// quickLiveness has robots go offline quickly once global state is cut off from them, and streamed
+// again soon after. It returns the function that puts the settings of the config back.
+func quickLiveness() func() {
+	return global.State.SetLiveness(global.Liveness{StaleAfter: time.Second, OfflineAfter: 2 * time.Second, ReconnectIntv: 100 * time.Millisecond})
+}
+
+// waitForStream waits for global state to stream robots from the fleet again.
+func waitForStream(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !global.State.Streaming(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected robots to be streamed again")
+		}
+	}
+}
+
+// homes is where resetRobots puts every robot back.
+var homes = map[string]fleet.Pose{
+	"freight1": {X: 0, Y: 0},
+	"freight2": {X: 0, Y: 2},
+	"freight3": {X: 0, Y: -2},
+}
+
+// resetRobots puts every robot back IDLE at its home with a full battery, so that a test does not
+// depend on where the tests before it left the robots.
+func resetRobots(t *testing.T) {
+	t.Helper()
+	for name, home := range homes {
+		placeRobot(t, name, home, 100)
+	}
+}
+
+// placeRobot puts robot name IDLE at pose with its battery at battery percent, and waits for global
+// state to catch up with it.
+func placeRobot(t *testing.T, name string, pose fleet.Pose, battery float64) {
+	t.Helper()
+	if err := fleet.Default().PlaceRobot(name, pose, battery); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	placed := func(robots []*fleet.Robot) bool {
+		for _, robot := range robots {
+			if robot.Name == name {
+				return robot.Status == "IDLE" && robot.CurrentPose == pose
+			}
+		}
+
+		return false
+	}
+
+	if _, err := global.State.WaitFor(ctx, placed); err != nil {
+		t.Fatalf("expected %s to be placed at %v, got %v", name, pose, err)
+	}
+}
+
+func TestCancelWorkflow(t *testing.T) {
+	resetRobots(t)
+	start := fetchRobot(t, "freight1").CurrentPose
+
+	action := wf.NavigateTo(-10, -10)
+	action.Wait = true
+
+	root := wf.NewRoot("start")
+	A := wf.NewJob([]wf.Node{root}, "navigate to (-10, -10) and wait", "freight1", action)
+	B := wf.NewTerminal([]wf.Node{A}, "freight1 has reached (-10, -10)")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancel()
+
+	events := &recorder{}
+	if _, err := wf.RunContext(ctx, root, events); err != context.DeadlineExceeded {
+		t.Fatalf("expected run to be cancelled, got %v", err)
+	}
+
+	if A.State() != wf.StateCancelled || B.State() != wf.StateCancelled {
+		t.Errorf("expected unfinished nodes to be cancelled, got %s and %s", A.State(), B.State())
+	}
+
+	expected := map[string]string{
+		A.Name(): "ready, started, cancelled",
+		B.Name(): "cancelled",
+	}
+	for name, order := range expected {
+		if got := strings.Join(events.of(name), ", "); got != order {
+			t.Errorf("expected %q to be %s, got %s", name, order, got)
+		}
+	}
+
+	// The mission must have been cancelled, leaving freight1 idle somewhere along the way.
+	time.Sleep(viper.GetDuration("robot.update_intv") * 3)
+	robot := fetchRobot(t, "freight1")
+	if robot.Status != "IDLE" || robot.CurrentPose == start || robot.CurrentPose == (fleet.Pose{X: -10, Y: -10}) {
+		t.Errorf("expected freight1 to stop short of (-10, -10), got %s at %v", robot.Status, robot.CurrentPose)
+	}
+}
+
+func TestRetryWorkflow(t *testing.T) {
+	resetRobots(t)
+	doc := `
+nodes:
+  - {name: start, type: root}
+  - name: send freight1 far away
+    type: job
+    device: freight1
+    action: {target: {x: -10, y: -10}, wait: true}
+    timeout: 200ms
+    retry: {max_attempts: 2, backoff: 100ms}
+    dependencies: [start]
+  - {name: end, type: terminal, dependencies: [send freight1 far away]}
+`
+
+	root, err := wf.Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := &recorder{}
+	result, err := wf.Run(root, events)
+	runErr, ok := err.(*wf.RunError)
+	if !ok || len(runErr.Failed) != 1 || len(runErr.Skipped) != 1 {
+		t.Fatalf("expected one failed and one skipped node, got %v", err)
+	}
+
+	job := runErr.Failed[0].Node.(*wf.Job)
+	if attempts := job.Attempts(); len(attempts) != 2 || attempts[1].Err == nil {
+		t.Errorf("expected 2 failed attempts, got %v", attempts)
+	}
+
+	if res := result.Get(job); res.State != wf.StateFailed || res.Err == nil || len(res.Attempts) != 2 {
+		t.Errorf("unexpected result for %q: %+v", job.Name(), res)
+	}
+
+	// Nodes run concurrently, so events are only ordered for each node.
+	expected := map[string]string{
+		"start":                  "ready, started, succeeded",
+		"send freight1 far away": "ready, started, failed",
+		"end":                    "skipped",
+	}
+	for name, order := range expected {
+		if got := strings.Join(events.of(name), ", "); got != order {
+			t.Errorf("expected %q to be %s, got %s", name, order, got)
+		}
+	}
+
+	if last := events.events[len(events.events)-1]; last != "finished" {
+		t.Errorf("expected run to finish last, got %s", last)
+	}
+
+	// Attempting a job that requires a group missing from the config again would fail the same way.
+	root = wf.NewRoot("start")
+	invalid := wf.NewJob([]wf.Node{root}, "send a robot of nowhere", "", wf.NavigateTo(1, 1), wf.Allocate(wf.Requirement{Group: "nowhere"}), wf.WithRetry(wf.Retry{MaxAttempts: 3, Backoff: time.Hour}))
+	wf.NewTerminal([]wf.Node{invalid}, "end")
+
+	start := time.Now()
+	if _, err := wf.Run(root); err == nil {
+		t.Fatal("expected the missing group to fail the run")
+	}
+
+	if attempts := invalid.(*wf.Job).Attempts(); len(attempts) != 1 || time.Since(start) > time.Second {
+		t.Errorf("expected a single attempt at the job, got %v", attempts)
+	}
+
+	// Neither would sending a robot again to where the fleet manager has no way to. The mock
+	// fleet is reached over HTTP for once, so that it answers with a 422.
+	warehouse, err := fleet.LoadMap()
+	if err != nil || warehouse == nil {
+		t.Fatalf("expected the warehouse map to load, got %v", err)
+	}
+
+	resetRobots(t)
+	fleet.Default().SetGrid(warehouse)
+	defer fleet.Default().SetGrid(nil)
+
+	testserver := httptest.NewServer(fleet.Routes(fleet.Default()))
+	defer testserver.Close()
+
+	adapter, err := global.NewHTTPFleet(global.HTTPConfig{URL: testserver.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global.UseFleet(adapter)
+	defer global.UseFleet(testFleet)
+
+	root = wf.NewRoot("start")
+	shelf := wf.NewJob([]wf.Node{root}, "send freight3 onto a shelf", "freight3", wf.NavigateTo(0, 6.5), wf.WithRetry(wf.Retry{MaxAttempts: 3, Backoff: time.Hour}))
+	wf.NewTerminal([]wf.Node{shelf}, "end")
+
+	start = time.Now()
+	if _, err := wf.Run(root); err == nil || !strings.Contains(err.Error(), "422") {
+		t.Fatalf("expected the fleet manager to refuse the target with a 422, got %v", err)
+	}
+
+	if attempts := shelf.(*wf.Job).Attempts(); len(attempts) != 1 || time.Since(start) > time.Second {
+		t.Errorf("expected a single attempt at the job, got %v", attempts)
+	}
+}
+
+func TestFailurePolicies(t *testing.T) {
+	cases := []struct {
+		policy wf.FailurePolicy
+
+		// sibling is the expected state of the sibling of the failed job, and descendant that of
+		// its descendant. Aborting a run may skip the descendant before it gets cancelled.
+		sibling        wf.State
+		descendant     string
+		fatal, aborted bool
+	}{
+		{wf.FailFast, wf.StateCancelled, "CANCELLED or SKIPPED", true, true},
+		{wf.SkipDescendants, wf.StateSucceeded, "SKIPPED", true, false},
+		{wf.ContinueAnyway, wf.StateSucceeded, "SUCCEEDED", false, false},
+	}
+
+	for _, c := range cases {
+		t.Run(string(c.policy), func(t *testing.T) {
+			resetRobots(t)
+
+			// The sibling takes freight1 a second away, so that it is still on its way when the
+			// ghost job fails.
+			pose := fetchRobot(t, "freight1").CurrentPose
+			action := wf.NavigateTo(pose.X+10, pose.Y)
+			action.Wait = true
+
+			root := wf.NewRoot("start")
+			failed := wf.NewJob([]wf.Node{root}, "send ghost", "ghost", wf.NavigateTo(1, 1), wf.OnFailure(c.policy), wf.WithTimeout(100*time.Millisecond))
+			descendant := wf.NewTerminal([]wf.Node{failed}, "after ghost")
+			sibling := wf.NewJob([]wf.Node{root}, "send freight1", "freight1", action)
+			wf.NewTerminal([]wf.Node{sibling}, "after freight1")
+
+			result, err := wf.Run(root)
+			runErr, ok := err.(*wf.RunError)
+			if !ok {
+				t.Fatalf("expected a run error, got %v", err)
+			}
+
+			if len(runErr.Failed) != 1 || runErr.Failed[0].Node != failed || runErr.Failed[0].Err == nil || runErr.Failed[0].Fatal != c.fatal {
+				t.Errorf("expected the ghost job to be the only failure, fatal %v, got %+v", c.fatal, runErr.Failed)
+			}
+
+			if runErr.Fatal() != c.fatal || runErr.Aborted != c.aborted {
+				t.Errorf("expected the run to be fatal %v and aborted %v, got %v", c.fatal, c.aborted, runErr)
+			}
+
+			if skipped := runErr.Skipped[descendant]; c.policy != wf.FailFast && (c.policy == wf.SkipDescendants) != (len(skipped) == 1 && skipped[0] == failed) {
+				t.Errorf("unexpected skipped nodes %v", runErr.Skipped)
+			}
+
+			if res := result.Get(failed); res.State != wf.StateFailed {
+				t.Errorf("expected the ghost job to fail, got %s", res.State)
+			}
+
+			if res := result.Get(sibling); res.State != c.sibling {
+				t.Errorf("expected the sibling to be %s, got %s", c.sibling, res.State)
+			}
+
+			if res := result.Get(descendant); !strings.Contains(c.descendant, string(res.State)) {
+				t.Errorf("expected the descendant to be %s, got %s", c.descendant, res.State)
+			}
+		})
+	}
+}
+
+// recorder is an EventListener that remembers every event it was told about.
+type recorder struct {
+	wf.NopListener
+	events []string
+}
+
+func (r *recorder) NodeReady(n wf.Node)              { r.events = append(r.events, "ready "+n.Name()) }
+func (r *recorder) NodeStarted(n wf.Node)            { r.events = append(r.events, "started "+n.Name()) }
+func (r *recorder) NodeSucceeded(n wf.Node)          { r.events = append(r.events, "succeeded "+n.Name()) }
+func (r *recorder) NodeFailed(n wf.Node, _ error)    { r.events = append(r.events, "failed "+n.Name()) }
+func (r *recorder) NodeSkipped(n wf.Node)            { r.events = append(r.events, "skipped "+n.Name()) }
+func (r *recorder) NodeCancelled(n wf.Node)          { r.events = append(r.events, "cancelled "+n.Name()) }
+func (r *recorder) RunFinished(*wf.RunResult, error) { r.events = append(r.events, "finished") }
+
+// of returns the events of the node with the given name.
+func (r *recorder) of(name string) []string {
+	events := []string{}
+	for _, e := range r.events {
+		if strings.HasSuffix(e, " "+name) {
+			events = append(events, strings.TrimSuffix(e, " "+name))
+		}
+	}
+
+	return events
+}
+
+func TestResumeWorkflow(t *testing.T) {
+	resetRobots(t)
+	doc := `
+nodes:
+  - {name: start, type: root}
+  - name: send freight2
+    type: job
+    device: freight2
+    action: {target: {x: 5, y: 5}}
+    dependencies: [start]
+  - name: check freight2
+    type: conditional
+    condition: {at_pose: {robot: freight2, x: 5, y: 5, tolerance: 0.1}}
+    dependencies: [send freight2]
+    else: [not arrived]
+  - {name: arrived, type: terminal, dependencies: [check freight2]}
+  - {name: not arrived, type: terminal, dependencies: [check freight2]}
+`
+
+	root, err := wf.Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taken := false
+	cp := &wf.Checkpoint{
+		RunID:      "resumed",
+		Definition: doc,
+		Nodes: map[string]*wf.NodeCheckpoint{
+			"start":          {State: wf.StateSucceeded},
+			"send freight2":  {State: wf.StateSucceeded, Robot: "freight2"},
+			"check freight2": {State: wf.StateSucceeded, Cond: &taken},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := wf.NewFileStore(dir)
+	result, err := wf.RunFromCheckpoint(context.Background(), root, cp, wf.NewCheckpointer(store, cp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := result.Find("send freight2")[0]; res.State != wf.StateSucceeded || res.Robot != "freight2" || len(res.Attempts) != 0 {
+		t.Errorf("expected completed job not to run again, got %+v", res)
+	}
+
+	if target := fetchRobot(t, "freight2").TargetPose; target != nil && *target == (fleet.Pose{X: 5, Y: 5}) {
+		t.Error("expected freight2 not to be sent again")
+	}
+
+	saved, err := store.Load("resumed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.Nodes["arrived"].State != wf.StateSkipped || saved.Nodes["not arrived"].State != wf.StateSucceeded {
+		t.Errorf("expected the recorded branch to be taken again, got %+v", saved.Nodes)
+	}
+}
+
+func TestEngine(t *testing.T) {
+	// The recorder is not safe for concurrent use, the engine calls it one event at a time.
+	events := &recorder{}
+	engine := wf.NewEngine(nil, events)
+	if err := engine.RegisterSource("quick", []byte(`
+nodes:
+  - {name: start, type: root}
+  - {name: end, type: terminal, dependencies: [start]}
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := engine.RegisterSource("slow", []byte(`
+nodes:
+  - {name: start, type: root}
+  - {name: wait, type: conditional, dependencies: [start]}
+  - {name: end, type: terminal, dependencies: [wait]}
+`)); err != nil {
+		t.Fatal(err)
+	}
 
-	err := wf.Run(root)
+	ctx := context.Background()
+	a, err := engine.Start(ctx, "quick")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+
+	b, err := engine.Start(ctx, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := engine.Start(ctx, "quick")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.ID == c.ID || a.Root == c.Root {
+		t.Error("expected every run to get its own ID and graph")
+	}
+
+	if instances := engine.Instances(); len(instances) != 3 || instances[1] != b {
+		t.Errorf("expected 3 instances in the order they were started, got %v", instances)
+	}
+
+	if err := engine.Cancel(b.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Wait(); err != context.Canceled || b.Status() != wf.InstanceCancelled {
+		t.Errorf("expected %s to be cancelled, got %s: %v", b.ID, b.Status(), err)
+	}
+
+	for _, i := range []*wf.Instance{a, c} {
+		if _, err := i.Wait(); err != nil || i.Status() != wf.InstanceSucceeded {
+			t.Errorf("expected %s to succeed, got %s: %v", i.ID, i.Status(), err)
+		}
+	}
+
+	if i, ok := engine.Get(c.ID); !ok || i != c {
+		t.Errorf("expected to find instance %s", c.ID)
+	}
+
+	finished := 0
+	for _, e := range events.events {
+		if e == "finished" {
+			finished++
+		}
+	}
+
+	if finished != 3 {
+		t.Errorf("expected 3 runs to finish, got %d", finished)
+	}
+
+	if err := engine.Remove(c.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := engine.Get(c.ID); ok || len(engine.Instances()) != 2 {
+		t.Errorf("expected instance %s to be forgotten", c.ID)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	resetRobots(t)
+	if !global.State.Streaming() {
+		t.Fatal("expected robots to be pushed by the fleet")
+	}
+
+	// Polling is paused while robots are pushed by the fleet.
+	polls := func() int {
+		testFleet.mutex.Lock()
+		defer testFleet.mutex.Unlock()
+
+		return testFleet.polls
+	}
+
+	before := polls()
+	time.Sleep(3 * viper.GetDuration("global.polling_intv"))
+	if after := polls(); after != before {
+		t.Errorf("expected no poll while robots are streamed, got %d", after-before)
+	}
+
+	if _, err := global.State.AcquireLease("freight3", "run-a", "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := global.State.AcquireLease("freight3", "run-b", "", time.Minute); err == nil {
+		t.Error("expected a leased robot not to be leased again")
+	}
+
+	if _, err := global.State.RenewLease("freight3", "run-b", time.Minute); err == nil {
+		t.Error("expected only the owner to renew a lease")
+	}
+
+	// A released robot can only be leased again once global state has caught up with its mission,
+	// even while robots are pushed by the fleet. The poll that catches up is held back meanwhile.
+	testFleet.mutex.Lock()
+	released := global.State.ReleaseLease("freight3", "run-a")
+	_, err := global.State.AcquireLease("freight3", "run-b", "", time.Minute)
+	testFleet.mutex.Unlock()
+
+	if released != nil {
+		t.Fatal(released)
+	}
+
+	if err == nil {
+		t.Error("expected a released robot to wait for fresh state")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := global.State.WaitForLease(ctx, "freight3", "run-b", "", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := global.State.RenewLease("freight3", "run-b", time.Minute); err == nil {
+		t.Error("expected an expired lease not to be renewed")
+	}
+}
+
+func TestAllocateWorkflow(t *testing.T) {
+	doc := `
+nodes:
+  - {name: start, type: root}
+  - name: send the nearest freight
+    type: job
+    allocate: {group: freights, nearest: true}
+    action: {target: {x: 9, y: 9}, wait: true}
+    dependencies: [start]
+  - name: send it back
+    type: job
+    allocate: {same_as: send the nearest freight}
+    action: {target: {x: 10, y: 10}, wait: true}
+    dependencies: [send the nearest freight]
+  - {name: end, type: terminal, dependencies: [send it back]}
+`
+
+	// freight2 and freight3 are as near to (9, 9) as each other, and freight2 comes first by name.
+	// freight1 is further away.
+	resetRobots(t)
+	placeRobot(t, "freight2", fleet.Pose{X: 10, Y: 10}, 100)
+	placeRobot(t, "freight3", fleet.Pose{X: 8, Y: 8}, 100)
+
+	root, err := wf.Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := wf.Run(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"send the nearest freight", "send it back"} {
+		if res := result.Find(name)[0]; res.Robot != "freight2" {
+			t.Errorf("expected %q to use freight2, got %q", name, res.Robot)
+		}
+	}
+}
+
+// status returns a predicate for global.State.WaitFor that is satisfied once robot name is in
+// the given status.
+func status(name, status string) func([]*fleet.Robot) bool {
+	return func(robots []*fleet.Robot) bool {
+		for _, robot := range robots {
+			if robot.Name == name {
+				return robot.Status == status
+			}
+		}
+
+		return false
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	resetRobots(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := global.State.WaitFor(ctx, status("freight9", "IDLE")); err != context.DeadlineExceeded {
+		t.Errorf("expected to give up waiting on an unknown robot, got %v", err)
+	}
+
+	// Sending freight3 wakes up the wait as soon as global state learns about it.
+	woken := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		_, err := global.State.WaitFor(ctx, status("freight3", "WORKING"))
+		woken <- err
+	}()
+
+	if err := global.Fleet().SendToPose(context.Background(), "freight3", fleet.Pose{X: 10, Y: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-woken; err != nil {
+		t.Errorf("expected wait to be woken by freight3 starting its mission, got %v", err)
+	}
+}
+
+func TestHTTPFleet(t *testing.T) {
+	// The robots of a store of its own are sent around, so that no other test finds them moved.
+	store := fleet.NewStore()
+	defer store.CancelMission("freight3")
+
+	testserver := httptest.NewServer(fleet.Routes(store))
+	defer testserver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	adapter, err := global.NewHTTPFleet(global.HTTPConfig{URL: testserver.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	robots, err := adapter.ListRobots(ctx)
+	if err != nil || len(robots) != 3 {
+		t.Fatalf("expected 3 robots, got %d: %v", len(robots), err)
+	}
+
+	updates, err := adapter.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if robots := <-updates; len(robots) != 3 {
+		t.Errorf("expected every robot to be streamed first, got %d", len(robots))
+	}
+
+	if err := adapter.SendToPose(ctx, "freight3", fleet.Pose{X: 9, Y: 9}); err != nil {
+		t.Fatal(err)
+	}
+
+	if robots := <-updates; len(robots) != 1 || robots[0].Status != "WORKING" || *robots[0].TargetPose != (fleet.Pose{X: 9, Y: 9}) {
+		t.Errorf("expected freight3 to be streamed on its way to (9, 9), got %+v", robots[0])
+	}
+
+	if err := adapter.CancelMission(ctx, "freight3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := adapter.CancelMission(ctx, "freight3"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected freight3 to have no mission left, got %v", err)
+	}
+}
+
+func TestHTTPFleetConfig(t *testing.T) {
+	routes := fleet.LoadRoutes()
+	testserver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		routes.ServeHTTP(w, r)
+	}))
+	defer testserver.Close()
+
+	ca, err := ioutil.TempFile("", "fleet-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ca.Name())
+
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: testserver.Certificate().Raw})
+	ca.Close()
+
+	tests := []struct {
+		name string
+		conf global.HTTPConfig
+		err  string
+	}{
+		{"unknown authority", global.HTTPConfig{URL: testserver.URL, Token: "secret"}, "certificate"},
+		{"wrong token", global.HTTPConfig{URL: testserver.URL, Token: "guess", CAFile: ca.Name()}, "401"},
+		{"trusted", global.HTTPConfig{URL: testserver.URL, Token: "secret", CAFile: ca.Name()}, ""},
+		{"insecure", global.HTTPConfig{URL: testserver.URL, Token: "secret", InsecureSkipVerify: true}, ""},
+	}
+
+	for _, test := range tests {
+		adapter, err := global.NewHTTPFleet(test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = adapter.ListRobots(context.Background())
+		if test.err == "" && err != nil {
+			t.Errorf("%s: expected robots to be listed, got %v", test.name, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	if _, err := global.NewHTTPFleet(global.HTTPConfig{URL: testserver.URL, Token: "secret", Username: "admin"}); err == nil {
+		t.Error("expected a token and a username to be rejected")
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	adapter, err := global.NewHTTPFleet(global.HTTPConfig{URL: slow.URL, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := adapter.ListRobots(context.Background()); err == nil {
+		t.Error("expected the request to time out")
+	}
+}
+
+func TestOfflineRobot(t *testing.T) {
+	resetRobots(t)
+	defer quickLiveness()()
+	defer func() {
+		testFleet.restore()
+		waitForStream(t)
+		placeRobot(t, "freight2", homes["freight2"], 100)
+	}()
+
+	// sendAndCut runs a job that sends freight2 to target, and cuts global state off from the
+	// fleet once the robot is on its way. The error of the job is sent once the run is over.
+	sendAndCut := func(target fleet.Pose, opts ...wf.Option) <-chan error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if _, err := global.State.WaitFor(ctx, status("freight2", "IDLE")); err != nil {
+			t.Fatalf("expected freight2 to be IDLE, got %v", err)
+		}
+
+		action := wf.NavigateTo(target.X, target.Y)
+		action.Wait = true
+
+		root := wf.NewRoot("start")
+		job := wf.NewJob([]wf.Node{root}, "send freight2", "freight2", action, opts...)
+		wf.NewTerminal([]wf.Node{job}, "done")
+
+		errs := make(chan error, 1)
+		go func() {
+			result, err := wf.Run(root)
+			if err == nil {
+				err = result.Get(job).Err
+			}
+			errs <- err
+		}()
+
+		if _, err := global.State.WaitFor(ctx, status("freight2", "WORKING")); err != nil {
+			t.Fatalf("expected freight2 to start its mission, got %v", err)
+		}
+
+		testFleet.cut()
+		return errs
+	}
+
+	errs := sendAndCut(fleet.Pose{X: 21, Y: 21})
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "offline") {
+		t.Errorf("expected the job to fail once freight2 is offline, got %v", err)
+	}
+
+	resp := make(chan *fleet.Robot)
+	global.State.GetRobotByStatus <- global.RobotReqquest{Robot: "freight2", Status: global.StatusOffline, Response: resp}
+	if robot := <-resp; robot == nil {
+		t.Error("expected freight2 to be OFFLINE")
+	}
+
+	testFleet.restore()
+
+	errs = sendAndCut(fleet.Pose{X: -21, Y: -21}, wf.OnOffline(wf.PauseOffline))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := global.State.WaitFor(ctx, status("freight2", global.StatusOffline)); err != nil {
+		t.Fatalf("expected freight2 to go offline, got %v", err)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatalf("expected the job to be paused while freight2 is offline, got %v", err)
+	default:
+	}
+
+	testFleet.restore()
+	if err := <-errs; err != nil {
+		t.Errorf("expected the job to carry on once freight2 is back, got %v", err)
+	}
+
+	if robot := fetchRobot(t, "freight2"); robot.CurrentPose != (fleet.Pose{X: -21, Y: -21}) {
+		t.Errorf("expected freight2 to have completed its mission, got %+v", robot)
+	}
+}
+
+func TestMissions(t *testing.T) {
+	resetRobots(t)
+	testserver := httptest.NewServer(fleet.LoadRoutes())
+	defer testserver.Close()
+
+	request := func(method, path, body string) (int, *fleet.Mission) {
+		req, err := http.NewRequest(method, testserver.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		m := &fleet.Mission{}
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, nil
+		}
+
+		if err := json.NewDecoder(res.Body).Decode(m); err != nil {
+			t.Fatal(err)
+		}
+
+		return res.StatusCode, m
+	}
+
+	_, first := request(http.MethodPatch, "/api/robots/freight1/send/", `{"x": 40, "y": 40}`)
+	if first == nil || first.Status != fleet.MissionActive || first.Robot != "freight1" {
+		t.Fatalf("expected freight1 to start a mission, got %+v", first)
+	}
+
+	if code, _ := request(http.MethodPatch, "/api/robots/freight1/send/?policy=reject", `{"x": 0, "y": 40}`); code != http.StatusConflict {
+		t.Errorf("expected an overlapping mission to be rejected, got %d", code)
+	}
+
+	_, second := request(http.MethodPatch, "/api/robots/freight1/send/?policy=preempt", `{"x": 0, "y": 40}`)
+	if second == nil || second.ID == first.ID {
+		t.Fatalf("expected freight1 to start another mission, got %+v", second)
+	}
+
+	if _, m := request(http.MethodGet, fmt.Sprintf("/api/missions/%d", first.ID), ""); m == nil || m.Status != fleet.MissionPreempted || m.Ended == nil {
+		t.Errorf("expected the first mission to be preempted, got %+v", m)
+	}
+
+	time.Sleep(3 * viper.GetDuration("robot.update_intv"))
+	if _, m := request(http.MethodDelete, "/api/robots/freight1/mission/", ""); m == nil || m.ID != second.ID || m.Status != fleet.MissionCancelled {
+		t.Errorf("expected the second mission to be cancelled, got %+v", m)
+	}
+
+	// The robot stops straight away, and the preempted mission no longer moves it.
+	stopped := fetchRobot(t, "freight1")
+	time.Sleep(3 * viper.GetDuration("robot.update_intv"))
+	if robot := fetchRobot(t, "freight1"); robot.Status != "IDLE" || robot.TargetPose != nil || robot.CurrentPose != stopped.CurrentPose {
+		t.Errorf("expected freight1 to stay where it stopped at %+v, got %+v", stopped.CurrentPose, robot)
+	}
+
+	if code, _ := request(http.MethodGet, "/api/missions/0", ""); code != http.StatusNotFound {
+		t.Errorf("expected an unknown mission to be missing, got %d", code)
+	}
+
+	// Missions that ended long enough ago are forgotten, but not those in progress.
+	_, third := request(http.MethodPatch, "/api/robots/freight1/send/", `{"x": 0, "y": 40}`)
+	if third == nil {
+		t.Fatal("expected freight1 to start a third mission")
+	}
+	defer fleet.Default().CancelMission("freight1")
+
+	fleet.Default().SetMissionRetention(time.Millisecond)
+	defer fleet.Default().SetMissionRetention(0)
+
+	for _, id := range []int{first.ID, second.ID} {
+		if code, _ := request(http.MethodGet, fmt.Sprintf("/api/missions/%d", id), ""); code != http.StatusNotFound {
+			t.Errorf("expected mission %d to be forgotten, got %d", id, code)
+		}
+	}
+
+	if _, m := request(http.MethodGet, fmt.Sprintf("/api/missions/%d", third.ID), ""); m == nil || m.Status != fleet.MissionActive {
+		t.Errorf("expected the mission in progress to be kept, got %+v", m)
+	}
+}
+
+func TestGrid(t *testing.T) {
+	// A wall splits the map, except for a gap at the top, and the bottom right corner is walled in.
+	grid, err := fleet.LoadGrid(strings.NewReader(`
+; 10 x 6
+....#.....
+....#.....
+....#.....
+....#..###
+....#..#..
+....#..#..
+`), 1, fleet.Pose{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, to := fleet.Pose{X: 1.5, Y: 0.5}, fleet.Pose{X: 6.5, Y: 0.5}
+	if _, err := grid.Plan(from, to); !errors.Is(err, fleet.ErrNoPath) {
+		t.Errorf("expected no path through the wall, got %v", err)
+	}
+
+	grid, err = fleet.LoadGrid(strings.NewReader("....#.....\n..........\n....#.....\n....#..###\n....#..#..\n....#..#..\n"), 1, fleet.Pose{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := grid.Plan(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every leg of the path must stay clear of the wall, which means going through the gap.
+	length, current := 0.0, from
+	for _, waypoint := range path {
+		for i := 0; i <= 100; i++ {
+			p := fleet.Pose{X: current.X + (waypoint.X-current.X)*float64(i)/100, Y: current.Y + (waypoint.Y-current.Y)*float64(i)/100}
+			if grid.Occupied(p) {
+				t.Fatalf("expected path %v to avoid obstacles, it goes through %+v", path, p)
+			}
+		}
+
+		length += math.Hypot(waypoint.X-current.X, waypoint.Y-current.Y)
+		current = waypoint
+	}
+
+	if current != to || length < 10 {
+		t.Errorf("expected path %v to go around the wall to %+v", path, to)
+	}
+
+	if _, err := grid.Plan(from, fleet.Pose{X: 8.5, Y: 0.5}); !errors.Is(err, fleet.ErrNoPath) {
+		t.Errorf("expected the walled in corner to be unreachable, got %v", err)
+	}
+
+	if _, err := grid.Plan(from, fleet.Pose{X: 4.5, Y: 0.5}); !errors.Is(err, fleet.ErrNoPath) {
+		t.Errorf("expected a target inside an obstacle to be refused, got %v", err)
+	}
+
+	// The mock fleet server refuses to send a robot where the map has no way to.
+	warehouse, err := fleet.LoadMap()
+	if err != nil || warehouse == nil {
+		t.Fatalf("expected the warehouse map to load, got %v", err)
+	}
+
+	fleet.Default().SetGrid(warehouse)
+	defer fleet.Default().SetGrid(nil)
+
+	testserver := httptest.NewServer(fleet.LoadRoutes())
+	defer testserver.Close()
+
+	req, err := http.NewRequest(http.MethodPatch, testserver.URL+"/api/robots/freight3/send/", strings.NewReader(`{"x": 0, "y": 6.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a target on a shelf to be refused, got %d", res.StatusCode)
+	}
+}
+
+func TestTraffic(t *testing.T) {
+	// Line robots up without traffic rules first.
+	start := map[string]fleet.Pose{"freight1": {X: -5, Y: 10}, "freight2": {X: 5, Y: 10}, "freight3": {X: 0, Y: -10}}
+	for name, pose := range start {
+		placeRobot(t, name, pose, 100)
+	}
+
+	grid, err := fleet.LoadGrid(strings.NewReader(strings.Repeat(strings.Repeat(".", 40)+"\n", 40)), 1, fleet.Pose{X: -20, Y: -20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fleet.Default().SetGrid(grid)
+	fleet.Default().SetTraffic(&fleet.Traffic{CellSize: 1, GiveUpAfter: time.Second})
+	defer fleet.Default().SetTraffic(nil)
+	defer fleet.Default().SetGrid(nil)
+
+	updates, unsubscribe := fleet.Default().Subscribe()
+	defer unsubscribe()
+
+	// freight1 and freight2 swap places head-on, which deadlocks them until freight2 goes around.
+	first, err := fleet.Default().Send("freight1", start["freight2"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := fleet.Default().Send("freight2", start["freight1"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := false
+	timeout := time.After(10 * time.Second)
+	for fleet.Default().GetMission(first.ID).Status == fleet.MissionActive || fleet.Default().GetMission(second.ID).Status == fleet.MissionActive {
+		select {
+		case robot := <-updates:
+			blocked = blocked || (robot.Status == fleet.StatusBlocked && robot.BlockedBy != "")
+		case <-timeout:
+			t.Fatal("expected freight1 and freight2 to swap places")
+		}
+	}
+
+	if !blocked {
+		t.Error("expected freight1 and freight2 to block each other")
+	}
+
+	for _, m := range []*fleet.Mission{fleet.Default().GetMission(first.ID), fleet.Default().GetMission(second.ID)} {
+		if robot := fetchRobot(t, m.Robot); m.Status != fleet.MissionCompleted || robot.CurrentPose != m.Target {
+			t.Errorf("expected %s to reach %+v, got mission %+v and robot %+v", m.Robot, m.Target, m, robot)
+		}
+	}
+
+	// freight1 now sits where freight3 is sent, which blocks freight3 until it gives up.
+	action := wf.NavigateTo(start["freight2"].X, start["freight2"].Y)
+	action.Wait = true
+
+	root := wf.NewRoot("start")
+	job := wf.NewJob([]wf.Node{root}, "send freight3", "freight3", action)
+	wf.NewTerminal([]wf.Node{job}, "done")
+
+	result, _ := wf.Run(root)
+	if res := result.Get(job); res.Err == nil || !strings.Contains(res.Err.Error(), "stopped before it reached its target") {
+		t.Errorf("expected freight3 to give up, got %v", res.Err)
+	}
+
+	if robot := fetchRobot(t, "freight3"); robot.Status != "IDLE" || robot.CurrentPose == start["freight2"] {
+		t.Errorf("expected freight3 to stop short of freight1, got %+v", robot)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	// The robots of a store of its own cross paths, so that no other test finds them moved.
+	store := fleet.NewStore()
+	grid, err := fleet.LoadGrid(strings.NewReader(strings.Repeat(strings.Repeat(".", 40)+"\n", 40)), 1, fleet.Pose{X: -20, Y: -20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.SetGrid(grid)
+	for name, pose := range map[string]fleet.Pose{"freight1": {X: -8.5, Y: 0.5}, "freight2": {X: 0.5, Y: -1.5}, "freight3": {X: 10.5, Y: -10.5}} {
+		if err := store.PlaceRobot(name, pose, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.SetTraffic(&fleet.Traffic{CellSize: 1, ReserveAhead: 10, GiveUpAfter: 5 * time.Second})
+
+	updates, unsubscribe := store.Subscribe()
+	defer unsubscribe()
+
+	// freight1 reserves the cell where the paths cross from afar, before freight2 sets off for it.
+	first, err := store.Send("freight1", fleet.Pose{X: 9.5, Y: 0.5}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	freight1 := fleet.Pose{X: -8.5, Y: 0.5}
+	for freight1.X == -8.5 {
+		if robot := <-updates; robot.Name == "freight1" {
+			freight1 = robot.CurrentPose
+		}
+	}
+
+	second, err := store.Send("freight2", fleet.Pose{X: 0.5, Y: 5.5}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := false
+	timeout := time.After(10 * time.Second)
+	for store.GetMission(first.ID).Status == fleet.MissionActive || store.GetMission(second.ID).Status == fleet.MissionActive {
+		select {
+		case robot := <-updates:
+			switch {
+			case robot.Name == "freight1":
+				freight1 = robot.CurrentPose
+			case robot.Status == fleet.StatusBlocked && !blocked:
+				blocked = true
+				if robot.BlockedBy != "freight1" || freight1.X >= 0 {
+					t.Errorf("expected freight2 to wait for freight1 before it gets to the crossing, got %+v while freight1 is at %v", robot, freight1)
+				}
+			}
+		case <-timeout:
+			t.Fatal("expected freight1 and freight2 to cross paths")
+		}
+	}
+
+	if !blocked {
+		t.Error("expected freight2 to give way to freight1")
+	}
+
+	for _, m := range []*fleet.Mission{store.GetMission(first.ID), store.GetMission(second.ID)} {
+		if robot := store.GetRobot(m.Robot); m.Status != fleet.MissionCompleted || robot.CurrentPose != m.Target {
+			t.Errorf("expected %s to reach %+v, got mission %+v and robot %+v", m.Robot, m.Target, m, robot)
+		}
+	}
+}
+
+func TestBattery(t *testing.T) {
+	testserver := httptest.NewServer(fleet.LoadRoutes())
+	defer testserver.Close()
+
+	charge := func(body string) (int, *fleet.Mission) {
+		req, err := http.NewRequest(http.MethodPatch, testserver.URL+"/api/robots/freight1/charge/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, nil
+		}
+
+		m := &fleet.Mission{}
+		if err := json.NewDecoder(res.Body).Decode(m); err != nil {
+			t.Fatal(err)
+		}
+
+		return res.StatusCode, m
+	}
+
+	resetRobots(t)
+	names := []string{"freight1", "freight2", "freight3"}
+	if code, _ := charge(""); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a robot to have nowhere to charge without docks, got %d", code)
+	}
+
+	grid, err := fleet.LoadGrid(strings.NewReader("@dock near -15 15\n@dock far 15 -15\n"+strings.Repeat(strings.Repeat(".", 40)+"\n", 40)), 1, fleet.Pose{X: -20, Y: -20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fleet.Default().SetGrid(grid)
+	defer fleet.Default().SetGrid(nil)
+
+	// freight2 and freight3 use up battery as they cross the map.
+	for _, name := range names[1:] {
+		robot := fetchRobot(t, name)
+		target := fleet.Pose{X: 15, Y: 15}
+		if robot.CurrentPose.X > 0 {
+			target.X = -15
+		}
+		if robot.CurrentPose.Y > 0 {
+			target.Y = -15
+		}
+
+		if _, err := fleet.Default().Send(name, target, fleet.PreemptMission); err != nil {
+			t.Fatal(err)
+		}
+
+		for fetchRobot(t, name).Status != "IDLE" {
+			time.Sleep(viper.GetDuration("robot.update_intv"))
+		}
+
+		distance := math.Hypot(target.X-robot.CurrentPose.X, target.Y-robot.CurrentPose.Y)
+		expected := viper.GetFloat64("battery.drain_per_meter") * distance
+		if used := robot.Battery - fetchRobot(t, name).Battery; used < expected*0.99 {
+			t.Errorf("expected %s to use %v%% of its battery over %vm, got %v%%", name, expected, distance, used)
+		}
+	}
+
+	if code, _ := charge(`{"dock": "nowhere"}`); code != http.StatusBadRequest {
+		t.Errorf("expected an unknown dock to be refused, got %d", code)
+	}
+
+	updates, unsubscribe := fleet.Default().Subscribe()
+	defer unsubscribe()
+
+	_, m := charge(`{"dock": "near"}`)
+	if m == nil || m.Dock != "near" || m.Target != grid.Docks["near"] {
+		t.Fatalf("expected freight1 to head for dock near, got %+v", m)
+	}
+
+	charging := false
+	timeout := time.After(20 * time.Second)
+	for fleet.Default().GetMission(m.ID).Status == fleet.MissionActive {
+		select {
+		case robot := <-updates:
+			charging = charging || (robot.Name == "freight1" && robot.Status == fleet.StatusCharging)
+		case <-timeout:
+			t.Fatal("expected freight1 to charge")
+		}
+	}
+
+	if robot := fetchRobot(t, "freight1"); !charging || fleet.Default().GetMission(m.ID).Status != fleet.MissionCompleted || robot.Battery < 99.9 {
+		t.Errorf("expected freight1 to charge until its battery is full, got %+v", robot)
+	}
+
+	// freight1 is the only robot with enough battery, even though the others are nearer.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range names {
+		if _, err := global.State.WaitFor(ctx, status(name, "IDLE")); err != nil {
+			t.Fatalf("expected %s to be IDLE, got %v", name, err)
+		}
+	}
+
+	near := fetchRobot(t, "freight2").CurrentPose
+	doc := fmt.Sprintf(`
+nodes:
+  - {name: start, type: root}
+  - name: send a charged freight
+    type: job
+    allocate: {nearest: true, min_battery: 99}
+    action: {target: {x: %v, y: %v}, wait: true}
+    dependencies: [start]
+  - {name: end, type: terminal, dependencies: [send a charged freight]}
+`, near.X, near.Y+1)
+
+	root, err := wf.Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := wf.Run(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := result.Find("send a charged freight")[0]; res.Robot != "freight1" {
+		t.Errorf("expected freight1 to be picked, got %q", res.Robot)
+	}
+
+	// freight3 runs out of battery 5m into its mission, and cannot even be sent to charge until it
+	// is put back somewhere.
+	placeRobot(t, "freight3", fleet.Pose{X: 0, Y: 0}, 0.5)
+	m, err = fleet.Default().Send("freight3", fleet.Pose{X: 0, Y: 15}, fleet.PreemptMission)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fleet.Default().GetMission(m.ID).Status == fleet.MissionActive {
+		time.Sleep(viper.GetDuration("robot.update_intv"))
+	}
+
+	if robot := fetchRobot(t, "freight3"); fleet.Default().GetMission(m.ID).Status != fleet.MissionFailed || robot.Battery != 0 || robot.CurrentPose.Y < 4 || robot.CurrentPose.Y > 6 {
+		t.Errorf("expected freight3 to stop about 5m away with an empty battery, got %+v", robot)
+	}
+
+	if _, err := fleet.Default().Send("freight3", fleet.Pose{X: 0, Y: 0}, fleet.PreemptMission); !errors.Is(err, fleet.ErrBatteryEmpty) {
+		t.Errorf("expected freight3 to be unable to move, got %v", err)
+	}
+
+	if _, err := fleet.Default().Charge("freight3", "", fleet.PreemptMission); !errors.Is(err, fleet.ErrBatteryEmpty) {
+		t.Errorf("expected freight3 to be unable to go and charge, got %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, testserver.URL+"/api/_robots/freight3/", strings.NewReader(`{"pose": {"x": 0, "y": 0}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if robot := fetchRobot(t, "freight3"); res.StatusCode != http.StatusOK || robot.Status != "IDLE" || robot.CurrentPose != (fleet.Pose{}) || robot.Battery < 99.9 {
+		t.Errorf("expected freight3 to be put back at (0, 0) with a full battery, got %d and %+v", res.StatusCode, robot)
+	}
+
+	if _, err := fleet.Default().Charge("freight3", "", fleet.PreemptMission); err != nil {
+		t.Errorf("expected freight3 to go and charge, got %v", err)
+	}
+	fleet.Default().CancelMission("freight3")
+}
+
+func TestFaults(t *testing.T) {
+	testserver := httptest.NewServer(fleet.LoadRoutes())
+	defer testserver.Close()
+	defer quickLiveness()()
+	defer func() {
+		fleet.Default().ClearFaults()
+		waitForStream(t)
+	}()
+
+	request := func(method, path, body string) (int, []byte) {
+		req, err := http.NewRequest(method, testserver.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res.StatusCode, b
+	}
+
+	if code, _ := request(http.MethodPut, "/api/_faults/", `{"error_rate": 2}`); code != http.StatusBadRequest {
+		t.Errorf("expected a rate above 1 to be refused, got %d", code)
+	}
+
+	// Every request fails late, except those to /api/_faults/.
+	if code, _ := request(http.MethodPut, "/api/_faults/", `{"error_rate": 1, "latency": "50ms"}`); code != http.StatusOK {
+		t.Fatalf("expected faults to be set, got %d", code)
+	}
+
+	start := time.Now()
+	if code, _ := request(http.MethodGet, "/api/robots/", ""); code < 500 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected listing robots to fail after 50ms, got %d after %v", code, time.Since(start))
+	}
+
+	f := fleet.Faults{}
+	if _, body := request(http.MethodGet, "/api/_faults/", ""); json.Unmarshal(body, &f) != nil || f.ErrorRate != 1 || f.Latency != fleet.Duration(50*time.Millisecond) {
+		t.Errorf("expected the faults that were set, got %s", body)
+	}
+
+	// The same seed brings the same faults, even with robots moving and requests coming in at once.
+	type outcome struct {
+		codes  []int
+		robots map[string]string
+	}
+
+	targets := map[string][2]fleet.Pose{
+		"freight1": {{X: 0, Y: 0}, {X: 20, Y: 0}},
+		"freight2": {{X: 0, Y: 5}, {X: -20, Y: 5}},
+	}
+
+	run := func() outcome {
+		fleet.Default().ClearFaults()
+		for name, poses := range targets {
+			placeRobot(t, name, poses[0], 100)
+		}
+
+		faults := `{"seed": 42, "error_rate": 0.5, "jitter": "5ms", "stuck_rate": 0.1, "error_status_rate": 0.02, "drop_rate": 0.5}`
+		if code, _ := request(http.MethodPut, "/api/_faults/", faults); code != http.StatusOK {
+			t.Fatalf("expected faults to be set, got %d", code)
+		}
+
+		for name, poses := range targets {
+			if _, err := fleet.Default().Send(name, poses[1], fleet.PreemptMission); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		o := outcome{robots: make(map[string]string)}
+		for i := 0; i < 20; i++ {
+			code, _ := request(http.MethodGet, "/api/robots/", "")
+			o.codes = append(o.codes, code)
+		}
+
+		// Every robot has arrived, got stuck or broken down by now.
+		time.Sleep(30 * viper.GetDuration("robot.update_intv"))
+		for name := range targets {
+			robot := fetchRobot(t, name)
+			o.robots[name] = fmt.Sprintf("%s at %v", robot.Status, robot.CurrentPose)
+			fleet.Default().CancelMission(name)
+		}
+
+		return o
+	}
+
+	if first, second := run(), run(); fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Errorf("expected the same seed to bring the same faults, got %+v and %+v", first, second)
+	}
+
+	fleet.Default().ClearFaults()
+
+	// freight2 gets stuck on its way, then breaks down.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"freight2", "freight3"} {
+		if _, err := global.State.WaitFor(ctx, status(name, "IDLE")); err != nil {
+			t.Fatalf("expected %s to be IDLE, got %v", name, err)
+		}
+	}
+
+	if err := fleet.Default().SetFaults(fleet.Faults{StuckRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	stuck := fetchRobot(t, "freight2").CurrentPose
+	action := wf.NavigateTo(stuck.X+10, stuck.Y)
+	action.Wait = true
+
+	root := wf.NewRoot("start")
+	job := wf.NewJob([]wf.Node{root}, "send freight2", "freight2", action)
+	wf.NewTerminal([]wf.Node{job}, "done")
+
+	results := make(chan *wf.RunResult, 1)
+	go func() {
+		result, _ := wf.Run(root)
+		results <- result
+	}()
+
+	if _, err := global.State.WaitFor(ctx, status("freight2", "WORKING")); err != nil {
+		t.Fatalf("expected freight2 to be WORKING, got %v", err)
+	}
+
+	time.Sleep(3 * viper.GetDuration("robot.update_intv"))
+	if robot := fetchRobot(t, "freight2"); robot.Status != "WORKING" || robot.CurrentPose != stuck {
+		t.Errorf("expected freight2 to be stuck at %+v, got %+v", stuck, robot)
+	}
+
+	if err := fleet.Default().SetFaults(fleet.Faults{ErrorStatusRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := (<-results).Get(job); res.Err == nil || !strings.Contains(res.Err.Error(), "broke down") {
+		t.Errorf("expected freight2 to break down, got %v", res.Err)
+	}
+
+	if robot := fetchRobot(t, "freight2"); robot.Status != fleet.StatusError {
+		t.Errorf("expected freight2 to be ERROR, got %+v", robot)
+	}
+
+	// freight3 goes offline, which global state notices.
+	if err := fleet.Default().SetFaults(fleet.Faults{Offline: []string{"freight3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, robot := range fleet.Default().GetRobots() {
+		if robot.Name == "freight3" {
+			t.Error("expected freight3 to be left out of robots")
+		}
+	}
+
+	if code, _ := request(http.MethodPatch, "/api/robots/freight3/send/", `{"x": 1, "y": 1}`); code != http.StatusServiceUnavailable {
+		t.Errorf("expected freight3 to be unavailable, got %d", code)
+	}
+
+	if _, err := global.State.WaitFor(ctx, status("freight3", global.StatusOffline)); err != nil {
+		t.Fatalf("expected freight3 to be OFFLINE, got %v", err)
+	}
+
+	// Changes to robots are dropped.
+	if err := fleet.Default().SetFaults(fleet.Faults{DropRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	updates, unsubscribe := fleet.Default().Subscribe()
+	defer unsubscribe()
+
+	if _, err := fleet.Default().Send("freight1", fleet.Pose{X: 1, Y: 1}, fleet.PreemptMission); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case robot := <-updates:
+		t.Errorf("expected every change to be dropped, got %+v", robot)
+	case <-time.After(3 * viper.GetDuration("robot.update_intv")):
+	}
+
+	// Clearing faults brings everything back.
+	if code, _ := request(http.MethodDelete, "/api/_faults/", ""); code != http.StatusOK {
+		t.Fatalf("expected faults to be cleared, got %d", code)
+	}
+
+	for _, name := range []string{"freight1", "freight2", "freight3"} {
+		if _, err := global.State.WaitFor(ctx, status(name, "IDLE")); err != nil {
+			t.Errorf("expected %s to be IDLE again, got %v", name, err)
+		}
 	}
 }
@@ -0,0 +1,43 @@
+package workflow
+
+import (
+	"fmt"
+	"wf-engine/fleet"
+)
+
+// Action types a Job can perform.
+const (
+	ActionNavigate = "navigate"
+)
+
+// Action describes what a Job asks its device to do. Unless Wait is set, a Job completes as soon
+// as the action has been handed to the robot.
+type Action struct {
+	Type   string     `yaml:"type"`
+	Target fleet.Pose `yaml:"target"`
+	Wait   bool       `yaml:"wait"`
+}
+
+// NavigateTo returns an action that sends a robot to the given pose.
+func NavigateTo(x, y float64) Action {
+	return Action{Type: ActionNavigate, Target: fleet.Pose{X: x, Y: y}}
+}
+
+func (a Action) validate() error {
+	switch a.Type {
+	case ActionNavigate:
+		return nil
+	default:
+		return fmt.Errorf("has unknown action type %q", a.Type)
+	}
+}
+
+// completed returns a condition that is satisfied once device has carried out the action.
+func (a Action) completed(device string) Condition {
+	switch a.Type {
+	case ActionNavigate:
+		return All(StatusIs(device, "IDLE"), AtPose(device, a.Target, 0))
+	default:
+		return Not(TruthyCondition)
+	}
+}
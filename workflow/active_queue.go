@@ -1,6 +1,10 @@
 package workflow
 
-import uuid "github.com/satori/go.uuid"
+import (
+	"context"
+
+	uuid "github.com/satori/go.uuid"
+)
 
 // NewActiveQueue returns an active queue.
 func NewActiveQueue() *ActiveQueue {
@@ -17,9 +21,8 @@ type ActiveQueue struct {
 	set map[uuid.UUID]Node
 }
 
-func (q *ActiveQueue) next() Node {
-	sig := <-q.mux
-
+// remove takes the node that emitted a ready signal out of the queue.
+func (q *ActiveQueue) remove(sig Signal) Node {
 	n, ok := q.set[sig.ID]
 	if !ok {
 		panic("node is not found in queue")
@@ -34,10 +37,17 @@ func (q *ActiveQueue) has(n Node) bool {
 	return ok
 }
 
-func (q *ActiveQueue) add(n Node) {
+func (q *ActiveQueue) add(ctx context.Context, n Node) {
 	q.set[n.ID()] = n
-	go n.Activate()
+	go n.Activate(ctx)
 	go func(id uuid.UUID, mux chan<- Signal, ready <-chan Signal) {
-		mux <- <-ready
+		select {
+		case <-ctx.Done():
+		case sig := <-ready:
+			select {
+			case <-ctx.Done():
+			case mux <- sig:
+			}
+		}
 	}(n.ID(), q.mux, n.Ready())
 }
@@ -0,0 +1,103 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"wf-engine/global"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Requirement lets a job pick its robot when it executes, instead of naming a device. The robot
+// that was picked is reported by Job.Robot and in the result of the run.
+type Requirement struct {
+	// Group narrows the robots down to a group declared in the groups section of the config. Any
+	// robot is picked when it is empty.
+	Group string `yaml:"group"`
+
+	// Nearest picks the robot that is closest to the target of the action, rather than the first
+	// robot by name.
+	Nearest bool `yaml:"nearest"`
+
+	// SameAs picks the robot used by the job with this name upstream.
+	SameAs string `yaml:"same_as"`
+
+	// MinBattery leaves out robots with less battery, in percent.
+	MinBattery float64 `yaml:"min_battery"`
+}
+
+func (r Requirement) validate() error {
+	if r.SameAs != "" && (r.Group != "" || r.Nearest || r.MinBattery != 0) {
+		return errors.New("requires the robot of another job, it cannot also require a group, the nearest robot or a battery level")
+	}
+
+	if r.MinBattery < 0 || r.MinBattery > 100 {
+		return fmt.Errorf("requires a battery level of %v%%, which is not between 0 and 100", r.MinBattery)
+	}
+
+	return nil
+}
+
+// Allocate lets a job without a device pick a robot that meets req when it executes.
+func Allocate(req Requirement) Option {
+	return func(o *options) {
+		o.requirement = &req
+	}
+}
+
+// groupMembers returns the robots of a group declared in the config.
+func groupMembers(group string) ([]string, error) {
+	members := viper.GetStringSlice("groups." + group)
+	if len(members) == 0 {
+		return nil, fmt.Errorf("group %s has no robot", group)
+	}
+
+	return members, nil
+}
+
+// allocate waits until the job can lease a robot, either its device or one that meets its
+// requirement.
+func (j *Job) allocate(ctx context.Context, owner string) (*global.Lease, error) {
+	req := j.options.requirement
+	if req == nil {
+		return waitForLease(ctx, j.device, owner)
+	}
+
+	if req.SameAs != "" {
+		for _, up := range upstreamJobs(j) {
+			if up.name == req.SameAs {
+				if up.Robot() == "" {
+					return nil, &permanentError{fmt.Errorf("job node %s requires the robot of %s, which did not use any", j.name, req.SameAs)}
+				}
+
+				return waitForLease(ctx, up.Robot(), owner)
+			}
+		}
+
+		return nil, &permanentError{fmt.Errorf("job node %s requires the robot of %s, which is not a job upstream", j.name, req.SameAs)}
+	}
+
+	pick := global.Pick{MinBattery: req.MinBattery}
+	if req.Group != "" {
+		members, err := groupMembers(req.Group)
+		if err != nil {
+			return nil, &permanentError{fmt.Errorf("job node %s %v", j.name, err)}
+		}
+
+		pick.Candidates = members
+	}
+
+	if req.Nearest {
+		pick.Near = &j.action.Target
+	}
+
+	lease, err := global.State.WaitForAnyLease(ctx, pick, owner, "IDLE", leaseTTL())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("job node %s picked robot %s", j.name, lease.Robot)
+	return lease, nil
+}
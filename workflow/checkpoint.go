@@ -0,0 +1,216 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Checkpoint is the durable record of a run. It holds the definition the graph was built from so
+// that the run can be resumed by another process.
+type Checkpoint struct {
+	RunID    string `json:"run_id"`
+	Workflow string `json:"workflow,omitempty"`
+
+	// Definition is the YAML or JSON workflow definition of the run, it is empty when the graph
+	// was built in code.
+	Definition string    `json:"definition,omitempty"`
+	Updated    time.Time `json:"updated"`
+
+	// Nodes is keyed by node name, which is why only graphs with unique names can be resumed.
+	Nodes map[string]*NodeCheckpoint `json:"nodes"`
+}
+
+// NodeCheckpoint is what is known about a node when its run is checkpointed.
+type NodeCheckpoint struct {
+	State State  `json:"state"`
+	Robot string `json:"robot,omitempty"`
+	Err   string `json:"error,omitempty"`
+
+	// Cond is the branch taken by a conditional that succeeded.
+	Cond *bool `json:"cond,omitempty"`
+}
+
+// CheckpointStore persists checkpoints.
+type CheckpointStore interface {
+	Save(cp *Checkpoint) error
+	Load(runID string) (*Checkpoint, error)
+}
+
+// NewFileStore returns a CheckpointStore that keeps one JSON file per run in dir.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// FileStore implements CheckpointStore on the local file system.
+type FileStore struct {
+	dir string
+}
+
+// Save writes a checkpoint. The previous checkpoint of the run is replaced atomically, so that a
+// process dying halfway through leaves it intact.
+func (s *FileStore) Save(cp *Checkpoint) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, cp.RunID)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(cp.RunID))
+}
+
+// Load reads the latest checkpoint of a run.
+func (s *FileStore) Load(runID string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(s.path(runID))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("run %s has no checkpoint in %s", runID, s.dir)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("checkpoint of run %s is corrupted: %v", runID, err)
+	}
+
+	return cp, nil
+}
+
+func (s *FileStore) path(runID string) string {
+	return filepath.Join(s.dir, runID+".json")
+}
+
+// NewCheckpointer returns an EventListener that saves cp to store every time a node changes state.
+// Passing the checkpoint a run is resumed from keeps recording into the same checkpoint.
+func NewCheckpointer(store CheckpointStore, cp *Checkpoint) *Checkpointer {
+	if cp.Nodes == nil {
+		cp.Nodes = make(map[string]*NodeCheckpoint)
+	}
+
+	return &Checkpointer{store: store, cp: cp}
+}
+
+// Checkpointer implements EventListener. Failing to save a checkpoint does not stop the run, it
+// is only logged.
+type Checkpointer struct {
+	NopListener
+
+	mutex sync.Mutex
+	store CheckpointStore
+	cp    *Checkpoint
+}
+
+// NodeReady records that n is waiting to execute.
+func (c *Checkpointer) NodeReady(n Node) {
+	c.record(n, &NodeCheckpoint{State: StateReady})
+}
+
+// NodeStarted records that n is executing. A job may have sent its robot on a mission from then
+// on.
+func (c *Checkpointer) NodeStarted(n Node) {
+	c.record(n, &NodeCheckpoint{State: StateRunning})
+}
+
+// NodeSucceeded records that n is done, along with the robot of a job and the branch taken by a
+// conditional.
+func (c *Checkpointer) NodeSucceeded(n Node) {
+	ncp := &NodeCheckpoint{State: StateSucceeded, Robot: stateOf(n).result(n).Robot}
+	if cond, ok := n.(*Conditional); ok {
+		taken := cond.cond
+		ncp.Cond = &taken
+	}
+
+	c.record(n, ncp)
+}
+
+// NodeFailed records that n has failed. A failed node is executed again when the run is resumed.
+func (c *Checkpointer) NodeFailed(n Node, err error) {
+	c.record(n, &NodeCheckpoint{State: StateFailed, Robot: stateOf(n).result(n).Robot, Err: err.Error()})
+}
+
+// NodeSkipped records that n is skipped.
+func (c *Checkpointer) NodeSkipped(n Node) {
+	c.record(n, &NodeCheckpoint{State: StateSkipped})
+}
+
+// NodeCancelled records that n has been cancelled. A cancelled node is executed again when the
+// run is resumed.
+func (c *Checkpointer) NodeCancelled(n Node) {
+	c.record(n, &NodeCheckpoint{State: StateCancelled, Robot: stateOf(n).result(n).Robot})
+}
+
+func (c *Checkpointer) record(n Node, ncp *NodeCheckpoint) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.cp.Nodes[n.Name()] = ncp
+	c.save()
+}
+
+func (c *Checkpointer) save() {
+	c.cp.Updated = time.Now()
+	if err := c.store.Save(c.cp); err != nil {
+		log.Errorf("failed to checkpoint run %s: %v", c.cp.RunID, err)
+	}
+}
+
+// RunFromCheckpoint resumes the run recorded in cp on root, a fresh graph built from the same
+// definition. Nodes that succeeded are not executed again, conditionals take the branch they took
+// before, and jobs that had started re-attach to the mission of their robot when the fleet
+// reports it is still in progress or already carried out. Everything else runs as usual.
+func RunFromCheckpoint(ctx context.Context, root Node, cp *Checkpoint, ls ...EventListener) (*RunResult, error) {
+	byName := make(map[string]Node)
+	for _, n := range collect(root) {
+		if _, ok := byName[n.Name()]; ok {
+			return nil, fmt.Errorf("cannot resume run %s, more than one node is named %q", cp.RunID, n.Name())
+		}
+
+		byName[n.Name()] = n
+	}
+
+	for name, ncp := range cp.Nodes {
+		n, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot resume run %s, node %q is not part of the graph", cp.RunID, name)
+		}
+
+		if cond, ok := n.(*Conditional); ok && ncp.State == StateSucceeded {
+			if ncp.Cond == nil {
+				return nil, fmt.Errorf("cannot resume run %s, conditional %q did not record its branch", cp.RunID, name)
+			}
+
+			cond.cond = *ncp.Cond
+		}
+
+		stateOf(n).restore(ncp)
+	}
+
+	return RunContext(ctx, root, ls...)
+}
@@ -0,0 +1,102 @@
+package workflow
+
+import (
+	"math"
+	"wf-engine/fleet"
+)
+
+// Snapshot is a read-only view of global state and workflow variables. Robots are copies, so a
+// Condition may inspect them freely without affecting the fleet.
+type Snapshot struct {
+	Robots    map[string]fleet.Robot
+	Variables map[string]string
+}
+
+// Robot looks up a robot by name.
+func (s Snapshot) Robot(name string) (fleet.Robot, bool) {
+	robot, ok := s.Robots[name]
+	return robot, ok
+}
+
+// AtPose is satisfied when robot is within tolerance meters of pose.
+func AtPose(robot string, pose fleet.Pose, tolerance float64) Condition {
+	return func(s Snapshot) bool {
+		r, ok := s.Robot(robot)
+		if !ok {
+			return false
+		}
+
+		return math.Hypot(r.CurrentPose.X-pose.X, r.CurrentPose.Y-pose.Y) <= tolerance
+	}
+}
+
+// StatusIs is satisfied when robot reports the given status.
+func StatusIs(robot, status string) Condition {
+	return func(s Snapshot) bool {
+		r, ok := s.Robot(robot)
+		return ok && r.Status == status
+	}
+}
+
+// BatteryAbove is satisfied when robot has at least level percent of battery left.
+func BatteryAbove(robot string, level float64) Condition {
+	return func(s Snapshot) bool {
+		r, ok := s.Robot(robot)
+		return ok && r.Battery >= level
+	}
+}
+
+// CountStatus is satisfied when at least min robots report the given status.
+func CountStatus(status string, min int) Condition {
+	return func(s Snapshot) bool {
+		count := 0
+		for _, r := range s.Robots {
+			if r.Status == status {
+				count++
+			}
+		}
+
+		return count >= min
+	}
+}
+
+// VariableIs is satisfied when a workflow variable holds the given value.
+func VariableIs(name, value string) Condition {
+	return func(s Snapshot) bool {
+		v, ok := s.Variables[name]
+		return ok && v == value
+	}
+}
+
+// All is satisfied when every condition is.
+func All(conds ...Condition) Condition {
+	return func(s Snapshot) bool {
+		for _, cond := range conds {
+			if !cond(s) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// Any is satisfied when at least one condition is.
+func Any(conds ...Condition) Condition {
+	return func(s Snapshot) bool {
+		for _, cond := range conds {
+			if cond(s) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Not negates a condition.
+func Not(cond Condition) Condition {
+	return func(s Snapshot) bool {
+		return !cond(s)
+	}
+}
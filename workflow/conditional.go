@@ -1,27 +1,34 @@
 package workflow
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"sync"
 	"time"
+	"wf-engine/global"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-// NewConditional returns a Conditional that satisfies the Node interface.
-func NewConditional(dependencies []Node, name string) Node {
+// NewConditional returns a Conditional that satisfies the Node interface. When condition is nil,
+// the conditional is satisfied once every job upstream has been carried out by its robot. Nodes
+// that depend on the conditional run when the condition is satisfied, unless they are moved to
+// the else branch with Else.
+func NewConditional(dependencies []Node, name string, condition Condition) Node {
 	c := &Conditional{
 		id:        uuid.NewV1(),
 		name:      name,
 		activated: false,
 		mutex:     &sync.Mutex{},
+		state:     newNodeState(),
 		ready:     make(chan Signal, 1),
 		done:      make(chan Signal, MaxNumDep),
 		parents:   make(map[uuid.UUID]Node),
 		children:  make(map[uuid.UUID]Node),
+		elses:     make(map[uuid.UUID]bool),
+		condition: condition,
 		cond:      false,
 	}
 
@@ -33,22 +40,29 @@ func NewConditional(dependencies []Node, name string) Node {
 	return c
 }
 
-// Conditional implements Node. It will only activate children that satisfy
-// the given condition.
+// Conditional implements Node. It evaluates a condition and only activates the children on the
+// branch that was taken; children on the other branch, and their descendants, are skipped. A node
+// is skipped only when every one of its parents was skipped or did not take the branch leading to
+// it, so a node that joins a skipped branch with anything that ran, including the other branch of
+// the same conditional, still executes.
 type Conditional struct {
 	id        uuid.UUID
 	name      string
 	activated bool
 	mutex     *sync.Mutex
+	state     *nodeState
 
 	// Means to communicate with other nodes
-	ready chan Signal
-	done  chan Signal
+	ready      chan Signal
+	done       chan Signal
+	activation Signal
 
 	parents  map[uuid.UUID]Node
 	children map[uuid.UUID]Node
+	elses    map[uuid.UUID]bool
 
-	cond bool
+	condition Condition
+	cond      bool
 }
 
 // ID returns Node's unique identifier.
@@ -61,6 +75,11 @@ func (c *Conditional) Name() string {
 	return c.name
 }
 
+// State returns Node's execution state.
+func (c *Conditional) State() State {
+	return c.state.get()
+}
+
 // Parents is a getter for a Node's dependency.
 func (c *Conditional) Parents() []Node {
 	nodes := make([]Node, 0, len(c.parents))
@@ -84,15 +103,9 @@ func (c *Conditional) AddParent(n Node) error {
 	return nil
 }
 
-// Children is a getter for a Node's dependents.
+// Children is a getter for a Node's dependents. It includes the children of both branches.
 func (c *Conditional) Children() []Node {
 	nodes := make([]Node, 0, len(c.children))
-
-	// If condition is not satisfied, return no children.
-	if !c.cond {
-		return nodes
-	}
-
 	for _, n := range c.children {
 		nodes = append(nodes, n)
 	}
@@ -118,6 +131,31 @@ func (c *Conditional) AddChild(n Node) error {
 	return nil
 }
 
+// Else moves a child of the conditional to the branch that is taken when the condition is not
+// satisfied. A child that also depends on a node outside of the conditional runs whenever that
+// node ran, whichever branch was taken.
+func (c *Conditional) Else(n Node) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.activated {
+		return errors.New("node has been locked down, cannot modify its parent/child")
+	}
+
+	if _, ok := c.children[n.ID()]; !ok {
+		return errors.New("node must depend on the conditional before joining its else branch")
+	}
+
+	c.elses[n.ID()] = true
+	return nil
+}
+
+// takes reports whether the branch leading to a child was taken. It must only be called once the
+// conditional has sent its done signal.
+func (c *Conditional) takes(child uuid.UUID) bool {
+	return c.cond != c.elses[child]
+}
+
 // IsConditional indicates whether a Node is conditional.
 func (c *Conditional) IsConditional() bool {
 	return true
@@ -134,31 +172,31 @@ func (c *Conditional) Done() <-chan Signal {
 }
 
 // Activate turns a node on and actively checks whether dependencies are met.
-func (c *Conditional) Activate() {
+func (c *Conditional) Activate(ctx context.Context) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	mux := make(chan Signal, len(c.parents))
-	met := make(map[uuid.UUID]struct{})
-	for _, dep := range c.parents {
-		go func(id uuid.UUID, mux chan<- Signal, done <-chan Signal) {
-			mux <- <-done
-		}(dep.ID(), mux, dep.Done())
+	sig, ok := awaitDependencies(ctx, c.id, c.parents)
+	if !ok {
+		c.state.cancel()
+		return
 	}
 
-	for sig := range mux {
-		met[sig.ID] = struct{}{}
-
-		if len(met) == len(c.parents) {
-			c.activated = true
-			c.ready <- Signal{ID: c.id, Pass: true}
-			return
-		}
+	c.activated = true
+	c.activation = sig
+	if sig.skipped() {
+		c.state.set(StateSkipped)
+	} else if c.state.completed() {
+		c.state.set(StateSucceeded)
+	} else {
+		c.state.set(StateReady)
 	}
+
+	c.ready <- sig
 }
 
 // Execute performs an action.
-func (c *Conditional) Execute() error {
+func (c *Conditional) Execute(ctx context.Context) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -166,34 +204,84 @@ func (c *Conditional) Execute() error {
 		return errors.New("must activate a node before execution")
 	}
 
-	// Wait a little bit for the global state to poll server, because I didn't use websocket.
-	time.Sleep(viper.GetDuration("conditional.wait_duration"))
+	if c.state.get() == StateSkipped {
+		logrus.Infof("conditional node %s is skipped", c.name)
+		for i := 0; i < len(c.children); i++ {
+			c.done <- Signal{ID: c.id, Pass: c.activation.Pass, Skip: true}
+		}
+
+		return nil
+	}
 
-	c.cond = true
-	for i := 1; i <= 3; i++ {
-		name := fmt.Sprintf("freight%d", i)
-		robot := requestIDLERobot(name)
-		if robot == nil {
-			c.cond = false
-			break
+	if c.state.get() == StateSucceeded {
+		logrus.Infof("conditional node %s had been evaluated before the run was resumed", c.name)
+		for i := 0; i < len(c.children); i++ {
+			c.done <- Signal{ID: c.id, Pass: true}
 		}
 
-		if robot.CurrentPose.X != 10 || robot.CurrentPose.Y != 10 {
-			c.cond = false
-			break
+		return nil
+	}
+
+	c.state.set(StateRunning)
+
+	// Global state is only up to date when robots are pushed by the fleet server, otherwise wait a
+	// little bit for it to poll the server.
+	if !global.State.Streaming() {
+		select {
+		case <-ctx.Done():
+			c.state.set(StateCancelled)
+			return ctx.Err()
+		case <-time.After(viper.GetDuration("conditional.wait_duration")):
 		}
 	}
 
+	condition := c.condition
+	if condition == nil {
+		conds := []Condition{}
+		for _, j := range upstreamJobs(c) {
+			conds = append(conds, j.action.completed(j.Robot()))
+		}
+		condition = All(conds...)
+	}
+
+	c.cond = condition(requestSnapshot(variablesOf(c)))
+
 	if c.cond {
 		logrus.Infof("conditional node %s has been satisfied ", c.name)
 	} else {
 		logrus.Infof("conditional node %s has NOT been satisfied ", c.name)
 	}
 
-	// TODO: Don't send done to children that does not satisfy condition.
+	c.state.set(StateSucceeded)
+
+	// Every child is notified; those on the branch that was not taken skip themselves.
 	for i := 0; i < len(c.children); i++ {
 		c.done <- Signal{ID: c.id, Pass: true}
 	}
 
 	return nil
 }
+
+// upstreamJobs returns every Job that n depends on, directly or through other nodes.
+func upstreamJobs(n Node) []*Job {
+	jobs := []*Job{}
+	seen := make(map[uuid.UUID]bool)
+
+	var visit func(n Node)
+	visit = func(n Node) {
+		for _, p := range n.Parents() {
+			if seen[p.ID()] {
+				continue
+			}
+
+			seen[p.ID()] = true
+			if j, ok := p.(*Job); ok {
+				jobs = append(jobs, j)
+			}
+			visit(p)
+		}
+	}
+	visit(n)
+
+	return jobs
+}
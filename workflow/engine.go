@@ -0,0 +1,307 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+)
+
+// Builder builds a fresh execution graph. Nodes can only be run once, so every run of a workflow
+// needs a graph of its own.
+type Builder func() (Node, error)
+
+// InstanceStatus describes where a workflow instance is at.
+type InstanceStatus string
+
+// Statuses of a workflow instance.
+const (
+	InstanceRunning   InstanceStatus = "RUNNING"
+	InstanceSucceeded InstanceStatus = "SUCCEEDED"
+	InstanceFailed    InstanceStatus = "FAILED"
+	InstanceCancelled InstanceStatus = "CANCELLED"
+)
+
+// Instance is a single run of a workflow.
+type Instance struct {
+	ID       string
+	Workflow string
+	Root     Node
+	Started  time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	result *RunResult
+	err    error
+}
+
+// Done returns a channel that is closed once the instance has finished.
+func (i *Instance) Done() <-chan struct{} {
+	return i.done
+}
+
+// Wait blocks until the instance has finished and returns what its run returned.
+func (i *Instance) Wait() (*RunResult, error) {
+	<-i.done
+	return i.result, i.err
+}
+
+// Status reports whether the instance is still running, and how it finished otherwise.
+func (i *Instance) Status() InstanceStatus {
+	select {
+	case <-i.done:
+	default:
+		return InstanceRunning
+	}
+
+	var runErr *RunError
+	if errors.As(i.err, &runErr) && !runErr.Fatal() {
+		return InstanceSucceeded
+	}
+
+	switch i.err {
+	case nil:
+		return InstanceSucceeded
+	case context.Canceled, context.DeadlineExceeded:
+		return InstanceCancelled
+	default:
+		return InstanceFailed
+	}
+}
+
+// Nodes returns the current state of every node of the instance, whether it has finished or not.
+func (i *Instance) Nodes() []*NodeResult {
+	return newRunResult(i.Root, i.Started).Nodes
+}
+
+type registration struct {
+	build  Builder
+	source []byte
+}
+
+// NewEngine returns an Engine. Every run is checkpointed to store unless it is nil, and every
+// listener is told about the progress of every run, one event at a time. Finished instances are
+// forgotten after engine.retention from the config, or kept until they are removed when it is
+// zero.
+func NewEngine(store CheckpointStore, ls ...EventListener) *Engine {
+	locked := make([]EventListener, 0, len(ls))
+	for _, l := range ls {
+		locked = append(locked, &lockedListener{EventListener: l, mutex: &sync.Mutex{}})
+	}
+
+	return &Engine{
+		mutex:     &sync.RWMutex{},
+		store:     store,
+		listeners: locked,
+		retention: viper.GetDuration("engine.retention"),
+		workflows: make(map[string]registration),
+		instances: make(map[string]*Instance),
+	}
+}
+
+// Engine runs any number of workflow instances concurrently and keeps track of them by run ID.
+type Engine struct {
+	mutex     *sync.RWMutex
+	store     CheckpointStore
+	listeners []EventListener
+	retention time.Duration
+
+	workflows map[string]registration
+	instances map[string]*Instance
+}
+
+// Register makes a workflow built in code available under name.
+func (e *Engine) Register(name string, build Builder) error {
+	return e.register(name, registration{build: build})
+}
+
+// RegisterSource makes a YAML or JSON workflow definition available under name. The definition is
+// loaded once to make sure it is valid, and saved along with the checkpoints of its runs.
+func (e *Engine) RegisterSource(name string, source []byte) error {
+	if _, err := Load(bytes.NewReader(source)); err != nil {
+		return err
+	}
+
+	return e.register(name, registration{build: sourceBuilder(source), source: source})
+}
+
+func (e *Engine) register(name string, reg registration) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, ok := e.workflows[name]; ok {
+		return fmt.Errorf("workflow %q is already registered", name)
+	}
+
+	e.workflows[name] = reg
+	return nil
+}
+
+// Start builds a fresh graph of the workflow registered under name and runs it in the
+// background. The instance is cancelled along with ctx, or through Cancel.
+func (e *Engine) Start(ctx context.Context, name string) (*Instance, error) {
+	e.mutex.RLock()
+	reg, ok := e.workflows[name]
+	e.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("workflow %q is not registered", name)
+	}
+
+	root, err := reg.build()
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &Checkpoint{RunID: uuid.NewV1().String(), Workflow: name, Definition: string(reg.source)}
+	return e.start(ctx, root, cp, func(ctx context.Context, ls ...EventListener) (*RunResult, error) {
+		return RunContext(ctx, root, ls...)
+	}), nil
+}
+
+// Resume picks up the run checkpointed under runID in the background, on a fresh graph built from
+// the definition saved in its checkpoint or, failing that, from the workflow it was started from.
+func (e *Engine) Resume(ctx context.Context, runID string) (*Instance, error) {
+	if e.store == nil {
+		return nil, errors.New("engine has no checkpoint store to resume runs from")
+	}
+
+	if i, ok := e.Get(runID); ok && i.Status() == InstanceRunning {
+		return nil, fmt.Errorf("run %s is still running", runID)
+	}
+
+	cp, err := e.store.Load(runID)
+	if err != nil {
+		return nil, err
+	}
+
+	build := sourceBuilder([]byte(cp.Definition))
+	if cp.Definition == "" {
+		e.mutex.RLock()
+		reg, ok := e.workflows[cp.Workflow]
+		e.mutex.RUnlock()
+
+		if !ok {
+			return nil, fmt.Errorf("cannot resume run %s, workflow %q is not registered", runID, cp.Workflow)
+		}
+
+		build = reg.build
+	}
+
+	root, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.start(ctx, root, cp, func(ctx context.Context, ls ...EventListener) (*RunResult, error) {
+		return RunFromCheckpoint(ctx, root, cp, ls...)
+	}), nil
+}
+
+func (e *Engine) start(ctx context.Context, root Node, cp *Checkpoint, run func(context.Context, ...EventListener) (*RunResult, error)) *Instance {
+	ctx, cancel := context.WithCancel(WithRunID(ctx, cp.RunID))
+	i := &Instance{
+		ID:       cp.RunID,
+		Workflow: cp.Workflow,
+		Root:     root,
+		Started:  time.Now(),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	ls := e.listeners
+	if e.store != nil {
+		ls = append([]EventListener{NewCheckpointer(e.store, cp)}, ls...)
+	}
+
+	e.mutex.Lock()
+	e.instances[i.ID] = i
+	e.mutex.Unlock()
+
+	go func() {
+		defer cancel()
+		i.result, i.err = run(ctx, ls...)
+		close(i.done)
+
+		if e.retention > 0 {
+			time.AfterFunc(e.retention, func() { e.forget(i) })
+		}
+	}()
+
+	return i
+}
+
+// Get returns the instance with the given run ID.
+func (e *Engine) Get(runID string) (*Instance, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	i, ok := e.instances[runID]
+	return i, ok
+}
+
+// Instances returns every instance the engine has started, from the oldest to the newest.
+func (e *Engine) Instances() []*Instance {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	instances := make([]*Instance, 0, len(e.instances))
+	for _, i := range e.instances {
+		instances = append(instances, i)
+	}
+
+	sort.Slice(instances, func(a, b int) bool {
+		return instances[a].Started.Before(instances[b].Started)
+	})
+
+	return instances
+}
+
+// Remove forgets the instance with the given run ID, which must have finished. Its checkpoint is
+// kept, so that it can still be resumed.
+func (e *Engine) Remove(runID string) error {
+	i, ok := e.Get(runID)
+	if !ok {
+		return fmt.Errorf("run %s does not exist", runID)
+	}
+
+	if i.Status() == InstanceRunning {
+		return fmt.Errorf("run %s is still running", runID)
+	}
+
+	e.forget(i)
+	return nil
+}
+
+// forget removes i from the instances of the engine, unless it has been resumed since.
+func (e *Engine) forget(i *Instance) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.instances[i.ID] == i {
+		delete(e.instances, i.ID)
+	}
+}
+
+// Cancel stops the instance with the given run ID. It does not wait for the instance to finish.
+func (e *Engine) Cancel(runID string) error {
+	i, ok := e.Get(runID)
+	if !ok {
+		return fmt.Errorf("run %s does not exist", runID)
+	}
+
+	i.cancel()
+	return nil
+}
+
+func sourceBuilder(source []byte) Builder {
+	return func() (Node, error) {
+		return Load(bytes.NewReader(source))
+	}
+}
@@ -0,0 +1,169 @@
+package workflow
+
+import "sync"
+
+// EventListener observes the execution of a graph. Listeners are registered on Run and are called
+// one at a time, in the order events happen, from the goroutine that runs the graph. A listener
+// that blocks therefore holds up the whole run and should hand slow work off to another goroutine.
+// Listeners registered on an Engine are shared by every instance it runs; they are still called one
+// at a time, but the events of concurrent instances interleave.
+// Nodes that had already succeeded before a run was resumed from a checkpoint only report
+// NodeSucceeded.
+type EventListener interface {
+	// NodeReady is called when every dependency of a node has been met.
+	NodeReady(n Node)
+
+	// NodeStarted is called right before a node that was not skipped executes.
+	NodeStarted(n Node)
+
+	// NodeSucceeded is called once a node has executed successfully.
+	NodeSucceeded(n Node)
+
+	// NodeFailed is called once a node has failed, including a job that is configured to continue
+	// anyway.
+	NodeFailed(n Node, err error)
+
+	// NodeSkipped is called instead of NodeReady when a node is skipped, either because it is on
+	// the branch of a conditional that was not taken or because a node upstream failed.
+	NodeSkipped(n Node)
+
+	// NodeCancelled is called for every node that had not finished when the run was stopped,
+	// either because its context was cancelled or because a node that fails fast failed.
+	NodeCancelled(n Node)
+
+	// RunFinished is called last, with the values that Run is about to return.
+	RunFinished(result *RunResult, err error)
+}
+
+// NopListener implements EventListener by ignoring every event. Embed it in a listener that is
+// only interested in a few events.
+type NopListener struct{}
+
+// NodeReady does nothing.
+func (NopListener) NodeReady(n Node) {}
+
+// NodeStarted does nothing.
+func (NopListener) NodeStarted(n Node) {}
+
+// NodeSucceeded does nothing.
+func (NopListener) NodeSucceeded(n Node) {}
+
+// NodeFailed does nothing.
+func (NopListener) NodeFailed(n Node, err error) {}
+
+// NodeSkipped does nothing.
+func (NopListener) NodeSkipped(n Node) {}
+
+// NodeCancelled does nothing.
+func (NopListener) NodeCancelled(n Node) {}
+
+// RunFinished does nothing.
+func (NopListener) RunFinished(result *RunResult, err error) {}
+
+// lockedListener calls an EventListener one event at a time, whichever goroutine the events come
+// from.
+type lockedListener struct {
+	EventListener
+	mutex *sync.Mutex
+}
+
+func (l *lockedListener) NodeReady(n Node) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.EventListener.NodeReady(n)
+}
+
+func (l *lockedListener) NodeStarted(n Node) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.EventListener.NodeStarted(n)
+}
+
+func (l *lockedListener) NodeSucceeded(n Node) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.EventListener.NodeSucceeded(n)
+}
+
+func (l *lockedListener) NodeFailed(n Node, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.EventListener.NodeFailed(n, err)
+}
+
+func (l *lockedListener) NodeSkipped(n Node) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.EventListener.NodeSkipped(n)
+}
+
+func (l *lockedListener) NodeCancelled(n Node) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.EventListener.NodeCancelled(n)
+}
+
+func (l *lockedListener) RunFinished(result *RunResult, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.EventListener.RunFinished(result, err)
+}
+
+// listeners fans every event out to each registered listener.
+type listeners []EventListener
+
+func (ls listeners) ready(n Node) {
+	if n.State() == StateSucceeded {
+		return
+	}
+
+	for _, l := range ls {
+		if n.State() == StateSkipped {
+			l.NodeSkipped(n)
+		} else {
+			l.NodeReady(n)
+		}
+	}
+}
+
+func (ls listeners) started(n Node) {
+	if n.State() == StateSkipped || n.State() == StateSucceeded {
+		return
+	}
+
+	for _, l := range ls {
+		l.NodeStarted(n)
+	}
+}
+
+func (ls listeners) executed(ex execution) {
+	for _, l := range ls {
+		switch ex.node.State() {
+		case StateSucceeded:
+			l.NodeSucceeded(ex.node)
+		case StateFailed:
+			l.NodeFailed(ex.node, ex.err)
+		}
+	}
+}
+
+// cancelled reports every node of the graph under root that has been cancelled.
+func (ls listeners) cancelled(root Node) {
+	for _, n := range collect(root) {
+		if n.State() != StateCancelled {
+			continue
+		}
+
+		for _, l := range ls {
+			l.NodeCancelled(n)
+		}
+	}
+}
+
+func (ls listeners) finished(result *RunResult, err error) (*RunResult, error) {
+	for _, l := range ls {
+		l.RunFinished(result, err)
+	}
+
+	return result, err
+}
@@ -0,0 +1,158 @@
+package workflow
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// stateColors maps execution states to the fill color used when exporting a graph with states.
+var stateColors = map[State]string{
+	StatePending:   "#ffffff",
+	StateReady:     "#aec7e8",
+	StateRunning:   "#ffdd71",
+	StateSucceeded: "#98df8a",
+	StateFailed:    "#ff9896",
+	StateSkipped:   "#c7c7c7",
+	StateCancelled: "#c5b0d5",
+}
+
+type edge struct {
+	from  string
+	to    string
+	label string
+}
+
+// exportGraph assigns stable identifiers to every node connected to root and lists its edges.
+func exportGraph(root Node) ([]Node, map[uuid.UUID]string, []edge) {
+	nodes := collect(root)
+	ids := make(map[uuid.UUID]string, len(nodes))
+	for i, n := range nodes {
+		ids[n.ID()] = fmt.Sprintf("n%d", i)
+	}
+
+	edges := []edge{}
+	for _, n := range nodes {
+		for _, c := range sorted(n.Children()) {
+			label := ""
+			if cond, ok := n.(*Conditional); ok {
+				label = fmt.Sprintf("%v", !cond.elses[c.ID()])
+			}
+
+			edges = append(edges, edge{from: ids[n.ID()], to: ids[c.ID()], label: label})
+		}
+	}
+
+	return nodes, ids, edges
+}
+
+// DOT renders the execution graph connected to root in Graphviz DOT format. When withState is
+// set, nodes are filled with a color that reflects their current execution state.
+func DOT(root Node, withState bool) string {
+	nodes, ids, edges := exportGraph(root)
+
+	b := &bytes.Buffer{}
+	b.WriteString("digraph workflow {\n")
+	b.WriteString("\trankdir=TB;\n")
+	for _, n := range nodes {
+		attrs := fmt.Sprintf("label=%q, shape=%s", n.Name(), dotShape(n))
+		if withState {
+			attrs += fmt.Sprintf(", style=filled, fillcolor=%q, tooltip=%q", stateColors[n.State()], n.State())
+		}
+
+		fmt.Fprintf(b, "\t%s [%s];\n", ids[n.ID()], attrs)
+	}
+
+	for _, e := range edges {
+		if e.label == "" {
+			fmt.Fprintf(b, "\t%s -> %s;\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(b, "\t%s -> %s [label=%q];\n", e.from, e.to, e.label)
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid renders the execution graph connected to root as a Mermaid flowchart. When withState
+// is set, nodes are styled with a class that reflects their current execution state.
+func Mermaid(root Node, withState bool) string {
+	nodes, ids, edges := exportGraph(root)
+
+	b := &bytes.Buffer{}
+	b.WriteString("flowchart TD\n")
+	for _, n := range nodes {
+		left, right := mermaidShape(n)
+		label := strings.Replace(n.Name(), `"`, "#quot;", -1)
+		fmt.Fprintf(b, "    %s%s\"%s\"%s\n", ids[n.ID()], left, label, right)
+	}
+
+	for _, e := range edges {
+		if e.label == "" {
+			fmt.Fprintf(b, "    %s --> %s\n", e.from, e.to)
+		} else {
+			fmt.Fprintf(b, "    %s -->|%s| %s\n", e.from, e.label, e.to)
+		}
+	}
+
+	if withState {
+		used := make(map[State]bool)
+		for _, n := range nodes {
+			used[n.State()] = true
+		}
+
+		for _, state := range []State{StatePending, StateReady, StateRunning, StateSucceeded, StateFailed, StateSkipped, StateCancelled} {
+			if used[state] {
+				fmt.Fprintf(b, "    classDef %s fill:%s\n", strings.ToLower(string(state)), stateColors[state])
+			}
+		}
+
+		for _, n := range nodes {
+			fmt.Fprintf(b, "    class %s %s\n", ids[n.ID()], strings.ToLower(string(n.State())))
+		}
+	}
+
+	return b.String()
+}
+
+// Export writes the execution graph connected to root, along with the execution state of every
+// node, to filename. It is written as a Mermaid flowchart when filename ends in .mmd, and in DOT
+// format otherwise.
+func Export(root Node, filename string) error {
+	content := DOT(root, true)
+	if strings.HasSuffix(filename, ".mmd") {
+		content = Mermaid(root, true)
+	}
+
+	return ioutil.WriteFile(filename, []byte(content), 0644)
+}
+
+func dotShape(n Node) string {
+	switch n.(type) {
+	case *Root:
+		return "oval"
+	case *Conditional:
+		return "diamond"
+	case *Terminal:
+		return "doublecircle"
+	default:
+		return "box"
+	}
+}
+
+func mermaidShape(n Node) (string, string) {
+	switch n.(type) {
+	case *Root:
+		return "([", "])"
+	case *Conditional:
+		return "{", "}"
+	case *Terminal:
+		return "((", "))"
+	default:
+		return "[", "]"
+	}
+}
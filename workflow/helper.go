@@ -1,70 +1,97 @@
 package workflow
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"net/http"
+	"context"
 	"time"
 	"wf-engine/fleet"
 	"wf-engine/global"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-func requestIDLERobot(name string) *fleet.Robot {
-	resp := make(chan *fleet.Robot)
-	global.State.GetRobotByStatus <- global.RobotReqquest{
-		Robot:    name,
-		Status:   "IDLE",
-		Response: resp,
-	}
+func requestSnapshot(variables map[string]string) Snapshot {
+	resp := make(chan []*fleet.Robot)
+	global.State.GetRobots <- global.RobotListRequest{Response: resp}
 
-	return <-resp
+	return newSnapshot(<-resp, variables)
 }
 
-func waitForIDLERobot(name string) *fleet.Robot {
-	var robot *fleet.Robot
-	for robot == nil {
-		resp := make(chan *fleet.Robot)
-		global.State.GetRobotByStatus <- global.RobotReqquest{
-			Robot:    name,
-			Status:   "IDLE",
-			Response: resp,
-		}
+func newSnapshot(robots []*fleet.Robot, variables map[string]string) Snapshot {
+	snapshot := Snapshot{
+		Robots:    make(map[string]fleet.Robot),
+		Variables: variables,
+	}
 
-		robot = <-resp
-		time.Sleep(time.Second)
+	for _, robot := range robots {
+		snapshot.Robots[robot.Name] = *robot
 	}
 
-	return robot
+	return snapshot
 }
 
-func httpSendRobotToNewPose(name string, pose fleet.Pose) error {
-	data, err := json.Marshal(pose)
-	if err != nil {
-		return err
+// leaseTTL returns how long robots are leased for at a time.
+func leaseTTL() time.Duration {
+	if ttl := viper.GetDuration("lease.ttl"); ttl > 0 {
+		return ttl
 	}
 
-	endpointf := "http://localhost:%d/api/robots/%s/send/"
-	url := fmt.Sprintf(endpointf, viper.GetInt("http.port"), name)
-	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(data))
-	if err != nil {
-		return err
-	}
+	return 10 * time.Second
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
+// waitForLease waits until robot is IDLE and leased to owner.
+func waitForLease(ctx context.Context, robot, owner string) (*global.Lease, error) {
+	return global.State.WaitForLease(ctx, robot, owner, "IDLE", leaseTTL())
+}
 
-	defer res.Body.Close()
-	if res.StatusCode >= 300 {
-		b := bytes.NewBuffer([]byte{})
-		b.ReadFrom(res.Body)
-		return fmt.Errorf("encountered bad HTTP status code %d - %s", res.StatusCode, b.String())
+// holdLease renews lease in the background until release is called, which also gives the robot
+// back. The returned context is cancelled if the lease is lost in the meantime, so that the robot
+// is no longer sent anywhere on its behalf.
+func holdLease(ctx context.Context, lease *global.Lease) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	ttl := leaseTTL()
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := global.State.RenewLease(lease.Robot, lease.Owner, ttl); err != nil {
+					log.Error(err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, func() {
+		close(stop)
+		cancel()
+		if err := global.State.ReleaseLease(lease.Robot, lease.Owner); err != nil {
+			log.Error(err)
+		}
 	}
+}
+
+// waitForCondition blocks until cond is satisfied by global state, which is checked every time
+// robots are updated.
+func waitForCondition(ctx context.Context, cond Condition, variables map[string]string) error {
+	_, err := global.State.WaitFor(ctx, func(robots []*fleet.Robot) bool {
+		return cond(newSnapshot(robots, variables))
+	})
+
+	return err
+}
+
+func sendRobotToNewPose(ctx context.Context, name string, pose fleet.Pose) error {
+	return global.Fleet().SendToPose(ctx, name, pose)
+}
 
-	return nil
+func cancelRobotMission(name string) error {
+	return global.Fleet().CancelMission(context.Background(), name)
 }
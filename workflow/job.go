@@ -1,26 +1,34 @@
 package workflow
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 	"wf-engine/fleet"
+	"wf-engine/global"
 
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 )
 
-// NewJob returns a Job that satisfies the Node interface.
-func NewJob(dependencies []Node, name string, device string) Node {
+// NewJob returns a Job that satisfies the Node interface. The device may be left empty when the
+// job picks its robot through the Allocate option.
+func NewJob(dependencies []Node, name string, device string, action Action, opts ...Option) Node {
 	j := &Job{
 		id:        uuid.NewV1(),
 		name:      name,
 		activated: false,
 		mutex:     &sync.Mutex{},
+		state:     newNodeState(),
 		ready:     make(chan Signal, 1),
 		done:      make(chan Signal, MaxNumDep),
 		parents:   make(map[uuid.UUID]Node),
 		children:  make(map[uuid.UUID]Node),
 		device:    device,
+		action:    action,
+		options:   newOptions(opts),
 	}
 
 	for _, dep := range dependencies {
@@ -37,15 +45,19 @@ type Job struct {
 	name      string
 	activated bool
 	mutex     *sync.Mutex
+	state     *nodeState
 
 	// Means to communicate with other nodes
-	ready chan Signal
-	done  chan Signal
+	ready      chan Signal
+	done       chan Signal
+	activation Signal
 
 	parents  map[uuid.UUID]Node
 	children map[uuid.UUID]Node
 
-	device string
+	device  string
+	action  Action
+	options options
 }
 
 // ID returns Node's unique identifier.
@@ -58,6 +70,11 @@ func (j *Job) Name() string {
 	return j.name
 }
 
+// State returns Node's execution state.
+func (j *Job) State() State {
+	return j.state.get()
+}
+
 // Parents is a getter for a Node's dependency.
 func (j *Job) Parents() []Node {
 	nodes := make([]Node, 0, len(j.parents))
@@ -113,6 +130,20 @@ func (j *Job) AddChild(n Node) error {
 	return nil
 }
 
+// Robot returns the robot the job has used, which is its device until it has leased one.
+func (j *Job) Robot() string {
+	if robot := j.state.result(j).Robot; robot != "" {
+		return robot
+	}
+
+	return j.device
+}
+
+// Attempts returns every attempt at executing the job so far.
+func (j *Job) Attempts() []Attempt {
+	return j.state.getAttempts()
+}
+
 // Ready returns a channel that emits ready signal.
 func (j *Job) Ready() <-chan Signal {
 	return j.ready
@@ -124,31 +155,32 @@ func (j *Job) Done() <-chan Signal {
 }
 
 // Activate turns a node on and actively checks whether dependencies are met.
-func (j *Job) Activate() {
+func (j *Job) Activate(ctx context.Context) {
 	j.mutex.Lock()
 	defer j.mutex.Unlock()
 
-	mux := make(chan Signal, len(j.parents))
-	met := make(map[uuid.UUID]struct{})
-	for _, dep := range j.parents {
-		go func(id uuid.UUID, mux chan<- Signal, done <-chan Signal) {
-			mux <- <-done
-		}(dep.ID(), mux, dep.Done())
+	sig, ok := awaitDependencies(ctx, j.id, j.parents)
+	if !ok {
+		j.state.cancel()
+		return
 	}
 
-	for sig := range mux {
-		met[sig.ID] = struct{}{}
-
-		if len(met) == len(j.parents) {
-			j.activated = true
-			j.ready <- Signal{ID: j.id, Pass: true}
-			return
-		}
+	j.activated = true
+	j.activation = sig
+	if sig.skipped() {
+		j.state.set(StateSkipped)
+	} else if j.state.completed() {
+		j.state.setRobot(j.state.restored().Robot)
+		j.state.set(StateSucceeded)
+	} else {
+		j.state.set(StateReady)
 	}
+
+	j.ready <- sig
 }
 
 // Execute performs an action.
-func (j *Job) Execute() error {
+func (j *Job) Execute(ctx context.Context) error {
 	j.mutex.Lock()
 	defer j.mutex.Unlock()
 
@@ -156,26 +188,268 @@ func (j *Job) Execute() error {
 		return errors.New("must activate a node before execution")
 	}
 
-	err := j.doWork()
+	if j.state.get() == StateSkipped {
+		log.Infof("job node %s is skipped", j.name)
+		for i := 0; i < len(j.children); i++ {
+			j.done <- Signal{ID: j.id, Pass: j.activation.Pass, Skip: true}
+		}
+
+		return nil
+	}
+
+	if j.state.get() == StateSucceeded {
+		log.Infof("job node %s had completed before the run was resumed", j.name)
+		for i := 0; i < len(j.children); i++ {
+			j.done <- Signal{ID: j.id, Pass: true}
+		}
+
+		return nil
+	}
+
+	j.state.set(StateRunning)
+	err := j.attempt(ctx)
+	if ctx.Err() != nil {
+		j.state.set(StateCancelled)
+		log.Infof("job node %s has been cancelled", j.name)
+		return ctx.Err()
+	}
+
 	if err != nil {
 		log.Error(err)
+		j.state.fail(err)
+		log.Infof("job node %s has failed", j.name)
+	} else {
+		j.state.set(StateSucceeded)
+		log.Infof("job node %s has completed", j.name)
 	}
-	log.Infof("job node %s has completed", j.name)
 
+	// Children of a failed job still run when its failure policy tells them to carry on.
+	pass := err == nil || j.options.onFailure == ContinueAnyway
 	for i := 0; i < len(j.children); i++ {
-		j.done <- Signal{ID: j.id, Pass: err == nil}
+		j.done <- Signal{ID: j.id, Pass: pass}
 	}
 
-	return nil
+	return err
 }
 
-func (j *Job) doWork() error {
-	robot := waitForIDLERobot(j.device)
-	err := httpSendRobotToNewPose(robot.Name, fleet.Pose{X: 10, Y: 10})
+// attempt runs the job until it succeeds, runs out of attempts or ctx is done. Every attempt is
+// bounded by the job's timeout.
+func (j *Job) attempt(ctx context.Context) error {
+	retry := j.options.retryPolicy()
+	timeout := j.options.attemptTimeout()
+
+	var err error
+	for i := 1; i <= retry.MaxAttempts; i++ {
+		if i > 1 {
+			delay := retry.delay(i)
+			log.Infof("job node %s will be attempted again in %s (%d/%d)", j.name, delay, i, retry.MaxAttempts)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		var attemptCtx context.Context
+		var cancel context.CancelFunc
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		} else {
+			attemptCtx, cancel = context.WithCancel(ctx)
+		}
+
+		start := time.Now()
+		err = j.doWork(attemptCtx)
+		if err != nil && ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("job node %s timed out after %s", j.name, timeout)
+		}
+		cancel()
+
+		j.state.addAttempt(Attempt{Start: start, End: time.Now(), Err: err})
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+	}
+
+	return err
+}
+
+// permanentError fails a job at once, since attempting it again would fail the same way.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (j *Job) doWork(ctx context.Context) error {
+	if err := j.action.validate(); err != nil {
+		return &permanentError{fmt.Errorf("job node %s %v", j.name, err)}
+	}
+
+	// The robot is leased for as long as the job uses it, so that no other job sends it anywhere.
+	owner := j.id.String()
+	if runID := RunID(ctx); runID != "" {
+		owner = runID + "/" + owner
+	}
+
+	lease := j.reattach(owner)
+	sent := lease != nil
+	if lease == nil {
+		var err error
+		lease, err = j.allocate(ctx, owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	leaseCtx, release := holdLease(ctx, lease)
+	defer release()
+
+	j.state.setRobot(lease.Robot)
+	err := j.carryOut(leaseCtx, lease.Robot, sent)
+	if err != nil && ctx.Err() == nil && leaseCtx.Err() != nil {
+		return fmt.Errorf("job node %s lost the lease of robot %s", j.name, lease.Robot)
+	}
+
+	return err
+}
+
+// carryOut sends robot on the mission of the job, unless it has already been sent, and waits for
+// the robot to complete it when the action says so.
+func (j *Job) carryOut(ctx context.Context, robot string, sent bool) error {
+	if !sent {
+		if err := sendRobotToNewPose(ctx, robot, j.action.Target); err != nil {
+			log.Error(err)
+			var clientErr *global.ClientError
+			if errors.As(err, &clientErr) {
+				return &permanentError{err}
+			}
+
+			return err
+		}
+	}
+
+	if !j.action.Wait {
+		return nil
+	}
+
+	err := j.waitForMission(ctx, robot)
+	if err != nil && ctx.Err() != nil {
+		// The run has been cancelled, the attempt timed out or the lease was lost while the robot
+		// is still on its way, so stop it.
+		if err := cancelRobotMission(robot); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return err
+}
+
+// waitForMission blocks until robot has completed the mission of the job. The attempt fails when
+// the mission ends before the robot gets there, for instance because other robots blocked its way
+// for too long or the robot broke down. When the robot goes offline on the way, the attempt fails
+// or waits for the robot to come back, depending on the offline policy of the job.
+func (j *Job) waitForMission(ctx context.Context, robot string) error {
+	completed := j.action.completed(robot)
+	started := false
+	for {
+		offline, ended, broken := false, false, false
+		err := waitForCondition(ctx, func(s Snapshot) bool {
+			r, ok := s.Robot(robot)
+			if !ok {
+				return completed(s)
+			}
+
+			if r.TargetPose != nil && *r.TargetPose == j.action.Target {
+				started = true
+			}
+
+			offline = r.Status == global.StatusOffline
+			broken = r.Status == fleet.StatusError
+			ended = started && r.TargetPose == nil && !completed(s)
+			return offline || ended || completed(s)
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		if ended && broken {
+			return fmt.Errorf("job node %s: robot %s broke down before it reached its target", j.name, robot)
+		}
+
+		if ended && !offline {
+			return fmt.Errorf("job node %s: robot %s stopped before it reached its target", j.name, robot)
+		}
+
+		if !offline {
+			return nil
+		}
+
+		if policy, _ := j.options.offlinePolicy(); policy != PauseOffline {
+			// Stop the robot in case it comes back.
+			if err := cancelRobotMission(robot); err != nil {
+				log.Error(err)
+			}
+
+			return fmt.Errorf("job node %s lost robot %s, which went offline", j.name, robot)
+		}
+
+		log.Warnf("job node %s is paused until robot %s is back online", j.name, robot)
+		err = waitForCondition(ctx, func(s Snapshot) bool {
+			r, ok := s.Robot(robot)
+			return ok && r.Status != global.StatusOffline
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("job node %s carries on, robot %s is back online", j.name, robot)
+	}
+}
+
+// reattach leases the robot of a job that had started before its run was resumed, when the fleet
+// reports that the robot is still heading to the target of the job or is already there. Any other
+// robot, or a job that has already been attempted in this run, has to be sent on a new mission.
+func (j *Job) reattach(owner string) *global.Lease {
+	cp := j.state.restored()
+	if cp == nil || cp.State != StateRunning || len(j.state.getAttempts()) > 0 {
+		return nil
+	}
+
+	// A job that picks its robot may not have recorded which one before the run was interrupted.
+	name := cp.Robot
+	if name == "" {
+		name = j.device
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	robot, ok := requestSnapshot(nil).Robot(name)
+	if !ok {
+		return nil
+	}
+
+	heading := robot.TargetPose != nil && *robot.TargetPose == j.action.Target
+	arrived := robot.Status == "IDLE" && robot.CurrentPose == j.action.Target
+	if !heading && !arrived {
+		return nil
+	}
+
+	lease, err := global.State.AcquireLease(robot.Name, owner, "", leaseTTL())
 	if err != nil {
-		log.Error(err)
-		return err
+		log.Infof("job node %s cannot re-attach to the mission of %s: %v", j.name, robot.Name, err)
+		return nil
 	}
 
-	return nil
+	log.Infof("job node %s re-attached to the mission of %s", j.name, robot.Name)
+	return lease
 }
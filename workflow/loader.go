@@ -0,0 +1,527 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+	"wf-engine/fleet"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Node types that can be declared in a workflow definition.
+const (
+	TypeRoot        = "root"
+	TypeJob         = "job"
+	TypeConditional = "conditional"
+	TypeTerminal    = "terminal"
+)
+
+// DefinitionError describes a problem found in a workflow definition. Line refers to the line
+// of the offending node (or dependency) in the source document.
+type DefinitionError struct {
+	Line int
+	Node string
+	Msg  string
+}
+
+func (e *DefinitionError) Error() string {
+	if e.Node == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+
+	return fmt.Sprintf("line %d: node %q %s", e.Line, e.Node, e.Msg)
+}
+
+type definition struct {
+	Variables map[string]string `yaml:"variables"`
+	Nodes     []*nodeDefinition `yaml:"nodes"`
+}
+
+type nodeDefinition struct {
+	Name         string               `yaml:"name"`
+	Type         string               `yaml:"type"`
+	Device       string               `yaml:"device"`
+	Allocate     *Requirement         `yaml:"allocate"`
+	Action       *Action              `yaml:"action"`
+	Condition    *conditionDefinition `yaml:"condition"`
+	Else         []yaml.Node          `yaml:"else"`
+	OnFailure    FailurePolicy        `yaml:"on_failure"`
+	OnOffline    OfflinePolicy        `yaml:"on_offline"`
+	Timeout      *time.Duration       `yaml:"timeout"`
+	Retry        *Retry               `yaml:"retry"`
+	Dependencies []yaml.Node          `yaml:"dependencies"`
+
+	line      int
+	condition Condition
+}
+
+// conditionDefinition declares a Condition. Exactly one of its fields must be set.
+type conditionDefinition struct {
+	All    []*conditionDefinition `yaml:"all"`
+	Any    []*conditionDefinition `yaml:"any"`
+	Not    *conditionDefinition   `yaml:"not"`
+	AtPose *struct {
+		Robot     string
+		X, Y      float64
+		Tolerance float64
+	} `yaml:"at_pose"`
+	StatusIs *struct {
+		Robot  string
+		Status string
+	} `yaml:"status_is"`
+	BatteryAbove *struct {
+		Robot string
+		Level float64
+	} `yaml:"battery_above"`
+	CountStatus *struct {
+		Status string
+		Min    int
+	} `yaml:"count_status"`
+	VariableIs *struct {
+		Name  string
+		Value string
+	} `yaml:"variable_is"`
+
+	line int
+}
+
+// UnmarshalYAML records the line on which a condition is declared.
+func (d *conditionDefinition) UnmarshalYAML(value *yaml.Node) error {
+	type plain conditionDefinition
+	if err := value.Decode((*plain)(d)); err != nil {
+		return err
+	}
+
+	if err := knownFields(value, reflect.TypeOf(plain{})); err != nil {
+		return err
+	}
+
+	d.line = value.Line
+	return nil
+}
+
+func (d *conditionDefinition) build() (Condition, error) {
+	set := 0
+	for _, ok := range []bool{
+		d.All != nil, d.Any != nil, d.Not != nil, d.AtPose != nil,
+		d.StatusIs != nil, d.BatteryAbove != nil, d.CountStatus != nil, d.VariableIs != nil,
+	} {
+		if ok {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return nil, &DefinitionError{Line: d.line, Msg: "condition must declare exactly one of all, any, not, at_pose, status_is, battery_above, count_status or variable_is"}
+	}
+
+	switch {
+	case d.All != nil || d.Any != nil:
+		defs := d.All
+		if d.Any != nil {
+			defs = d.Any
+		}
+
+		conds := make([]Condition, 0, len(defs))
+		for _, def := range defs {
+			cond, err := def.build()
+			if err != nil {
+				return nil, err
+			}
+
+			conds = append(conds, cond)
+		}
+
+		if d.All != nil {
+			return All(conds...), nil
+		}
+
+		return Any(conds...), nil
+	case d.Not != nil:
+		cond, err := d.Not.build()
+		if err != nil {
+			return nil, err
+		}
+
+		return Not(cond), nil
+	case d.AtPose != nil:
+		return AtPose(d.AtPose.Robot, fleet.Pose{X: d.AtPose.X, Y: d.AtPose.Y}, d.AtPose.Tolerance), nil
+	case d.StatusIs != nil:
+		return StatusIs(d.StatusIs.Robot, d.StatusIs.Status), nil
+	case d.BatteryAbove != nil:
+		return BatteryAbove(d.BatteryAbove.Robot, d.BatteryAbove.Level), nil
+	case d.CountStatus != nil:
+		return CountStatus(d.CountStatus.Status, d.CountStatus.Min), nil
+	default:
+		return VariableIs(d.VariableIs.Name, d.VariableIs.Value), nil
+	}
+}
+
+// UnmarshalYAML records the line on which a node is declared.
+func (d *nodeDefinition) UnmarshalYAML(value *yaml.Node) error {
+	type plain nodeDefinition
+	err := value.Decode((*plain)(d))
+	if err == nil {
+		err = knownFields(value, reflect.TypeOf(plain{}))
+	}
+
+	if defErr, ok := err.(*DefinitionError); ok && defErr.Node == "" {
+		defErr.Node = d.Name
+	}
+
+	if err != nil {
+		return err
+	}
+
+	d.line = value.Line
+	return nil
+}
+
+// Load parses a YAML or JSON workflow definition and builds its execution graph. It returns the
+// root node of the graph.
+//
+//	nodes:
+//	  - name: start
+//	    type: root
+//	  - name: send freight1
+//	    type: job
+//	    device: freight1
+//	    action:
+//	      type: navigate
+//	      target: {x: 10, y: 10}
+//	    on_failure: fail_fast
+//	    on_offline: pause
+//	    timeout: 30s
+//	    retry: {max_attempts: 3, backoff: 1s, max_backoff: 10s, jitter: 500ms}
+//	    dependencies: [start]
+//	  - name: send the nearest freight
+//	    type: job
+//	    allocate: {group: freights, nearest: true, min_battery: 20}
+//	    action: {target: {x: -10, y: -10}}
+//	    dependencies: [start]
+//	  - name: is freight1 close to (10, 10)?
+//	    type: conditional
+//	    condition:
+//	      at_pose: {robot: freight1, x: 10, y: 10, tolerance: 0.5}
+//	    dependencies: [send freight1]
+//	    else: [not there yet]
+//	  - name: done
+//	    type: terminal
+//	    dependencies: [is freight1 close to (10, 10)?]
+//	  - name: not there yet
+//	    type: terminal
+//	    dependencies: [is freight1 close to (10, 10)?]
+func Load(r io.Reader) (Node, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+
+	def := &definition{}
+	if err := dec.Decode(def); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(def.Nodes) == 0 {
+		return nil, errors.New("workflow definition does not declare any node")
+	}
+
+	return def.build()
+}
+
+func (def *definition) build() (Node, error) {
+	byName := make(map[string]*nodeDefinition)
+	for _, nd := range def.Nodes {
+		if nd.Name == "" {
+			return nil, &DefinitionError{Line: nd.line, Msg: "node is missing a name"}
+		}
+
+		if prev, ok := byName[nd.Name]; ok {
+			msg := fmt.Sprintf("is already declared on line %d", prev.line)
+			return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: msg}
+		}
+
+		byName[nd.Name] = nd
+	}
+
+	var root *nodeDefinition
+	for _, nd := range def.Nodes {
+		switch nd.Type {
+		case TypeRoot:
+			if root != nil {
+				msg := fmt.Sprintf("is a second root, %q is declared on line %d", root.Name, root.line)
+				return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: msg}
+			}
+
+			if len(nd.Dependencies) > 0 {
+				return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: "is a root and cannot have dependencies"}
+			}
+
+			root = nd
+		case TypeJob:
+			if nd.Device == "" && nd.Allocate == nil {
+				return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: "is a job and must specify a device or allocate a robot"}
+			}
+
+			if nd.Device != "" && nd.Allocate != nil {
+				return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: "is a job and cannot both specify a device and allocate a robot"}
+			}
+
+			if nd.Allocate != nil {
+				if err := nd.Allocate.validate(); err != nil {
+					return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: err.Error()}
+				}
+			}
+
+			if nd.Action == nil {
+				return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: "is a job and must specify an action"}
+			}
+
+			if nd.Action.Type == "" {
+				nd.Action.Type = ActionNavigate
+			}
+
+			if err := nd.Action.validate(); err != nil {
+				return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: err.Error()}
+			}
+
+			if nd.OnFailure == "" {
+				nd.OnFailure = SkipDescendants
+			}
+
+			if err := nd.OnFailure.validate(); err != nil {
+				return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: err.Error()}
+			}
+
+			if nd.OnOffline != "" {
+				if err := nd.OnOffline.validate(); err != nil {
+					return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: err.Error()}
+				}
+			}
+
+			if nd.Timeout != nil && *nd.Timeout < 0 {
+				msg := fmt.Sprintf("has a negative timeout %v", *nd.Timeout)
+				return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: msg}
+			}
+
+			if nd.Retry != nil {
+				if err := nd.Retry.validate(); err != nil {
+					return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: err.Error()}
+				}
+			}
+		case TypeConditional:
+			if nd.Condition != nil {
+				cond, err := nd.Condition.build()
+				if err != nil {
+					if defErr, ok := err.(*DefinitionError); ok {
+						defErr.Node = nd.Name
+					}
+					return nil, err
+				}
+
+				nd.condition = cond
+			}
+		case TypeTerminal:
+		default:
+			msg := fmt.Sprintf("has unknown type %q", nd.Type)
+			return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: msg}
+		}
+
+		if nd.Type != TypeRoot && len(nd.Dependencies) == 0 {
+			return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: "must depend on at least one node"}
+		}
+
+		if nd.Type != TypeJob && (nd.Timeout != nil || nd.Retry != nil || nd.OnOffline != "") {
+			return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: "is not a job and cannot have a timeout, a retry policy or an offline policy"}
+		}
+
+		if nd.Type != TypeConditional && len(nd.Else) > 0 {
+			return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: "is not a conditional and cannot have an else branch"}
+		}
+
+		for _, child := range nd.Else {
+			if _, ok := byName[child.Value]; !ok {
+				msg := fmt.Sprintf("has unknown node %q on its else branch", child.Value)
+				return nil, &DefinitionError{Line: child.Line, Node: nd.Name, Msg: msg}
+			}
+
+			if !nodeDependsOn(byName[child.Value], nd.Name) {
+				msg := fmt.Sprintf("has %q on its else branch, but it does not depend on the conditional", child.Value)
+				return nil, &DefinitionError{Line: child.Line, Node: nd.Name, Msg: msg}
+			}
+		}
+
+		for _, dep := range nd.Dependencies {
+			parent, ok := byName[dep.Value]
+			if !ok {
+				msg := fmt.Sprintf("depends on unknown node %q", dep.Value)
+				return nil, &DefinitionError{Line: dep.Line, Node: nd.Name, Msg: msg}
+			}
+
+			if parent.Type == TypeTerminal {
+				msg := fmt.Sprintf("depends on terminal node %q", dep.Value)
+				return nil, &DefinitionError{Line: dep.Line, Node: nd.Name, Msg: msg}
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("workflow definition does not declare a root node")
+	}
+
+	// Nodes can only be constructed once all of their dependencies exist, so they are built in
+	// dependency order. Whatever is left over after no more progress can be made is a cycle.
+	nodes := make(map[string]Node)
+	for len(nodes) < len(def.Nodes) {
+		progress := false
+		for _, nd := range def.Nodes {
+			if _, ok := nodes[nd.Name]; ok {
+				continue
+			}
+
+			deps := make([]Node, 0, len(nd.Dependencies))
+			for _, dep := range nd.Dependencies {
+				if n, ok := nodes[dep.Value]; ok {
+					deps = append(deps, n)
+				}
+			}
+
+			if len(deps) < len(nd.Dependencies) {
+				continue
+			}
+
+			nodes[nd.Name] = nd.build(deps)
+			progress = true
+		}
+
+		if !progress {
+			break
+		}
+	}
+
+	for _, nd := range def.Nodes {
+		if _, ok := nodes[nd.Name]; !ok {
+			return nil, &DefinitionError{Line: nd.line, Node: nd.Name, Msg: "is part of or depends on a dependency cycle"}
+		}
+	}
+
+	for _, nd := range def.Nodes {
+		for _, child := range nd.Else {
+			nodes[nd.Name].(*Conditional).Else(nodes[child.Value])
+		}
+	}
+
+	for name, value := range def.Variables {
+		nodes[root.Name].(*Root).SetVariable(name, value)
+	}
+
+	return nodes[root.Name], nil
+}
+
+func (nd *nodeDefinition) build(deps []Node) Node {
+	switch nd.Type {
+	case TypeRoot:
+		return NewRoot(nd.Name)
+	case TypeJob:
+		opts := []Option{OnFailure(nd.OnFailure)}
+		if nd.Timeout != nil {
+			opts = append(opts, WithTimeout(*nd.Timeout))
+		}
+
+		if nd.Retry != nil {
+			opts = append(opts, WithRetry(*nd.Retry))
+		}
+
+		if nd.OnOffline != "" {
+			opts = append(opts, OnOffline(nd.OnOffline))
+		}
+
+		if nd.Allocate != nil {
+			opts = append(opts, Allocate(*nd.Allocate))
+		}
+
+		return NewJob(deps, nd.Name, nd.Device, *nd.Action, opts...)
+	case TypeConditional:
+		return NewConditional(deps, nd.Name, nd.condition)
+	default:
+		return NewTerminal(deps, nd.Name)
+	}
+}
+
+var (
+	unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+	nodeType        = reflect.TypeOf(yaml.Node{})
+)
+
+// knownFields reports the first key of value that does not match a field of t, looking into the
+// nested values as well. The decoder only rejects unknown keys up to the first UnmarshalYAML
+// method, so the definitions that implement one check their own keys with it.
+func knownFields(value *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == nodeType || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+
+	switch {
+	case t.Kind() == reflect.Slice && value.Kind == yaml.SequenceNode:
+		for _, item := range value.Content {
+			if err := knownFields(item, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case t.Kind() == reflect.Struct && value.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			key := value.Content[i]
+			field, ok := yamlField(t, key.Value)
+			if !ok {
+				return &DefinitionError{Line: key.Line, Msg: fmt.Sprintf("has unknown field %q", key.Value)}
+			}
+
+			if err := knownFields(value.Content[i+1], field.Type); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// yamlField returns the field of t that the decoder fills in with the given key.
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		if name == key {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+func nodeDependsOn(nd *nodeDefinition, name string) bool {
+	if nd == nil {
+		return false
+	}
+
+	for _, dep := range nd.Dependencies {
+		if dep.Value == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,14 +1,43 @@
 package workflow
 
-import "github.com/satori/go.uuid"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
 
 // MaxNumDep is the maximum number of dependents/children a node may have.
 const MaxNumDep = 1000
 
+// State is the execution state of a node.
+type State string
+
+// Execution states of a node.
+const (
+	StatePending   State = "PENDING"
+	StateReady     State = "READY"
+	StateRunning   State = "RUNNING"
+	StateSucceeded State = "SUCCEEDED"
+	StateFailed    State = "FAILED"
+	StateSkipped   State = "SKIPPED"
+	StateCancelled State = "CANCELLED"
+)
+
 // Signal is used for cross-node dependency communication.
 type Signal struct {
 	ID   uuid.UUID
 	Pass bool
+
+	// Skip is set when the sender did not execute, because it sits on a branch that was not taken.
+	Skip bool
+}
+
+// skipped reports whether a node activated with this signal must skip its execution, either
+// because its branch was not taken or because a node upstream failed.
+func (s Signal) skipped() bool {
+	return s.Skip || !s.Pass
 }
 
 // Node composes an execution graph.
@@ -16,6 +45,7 @@ type Node interface {
 	// Getters
 	ID() uuid.UUID
 	Name() string
+	State() State
 	Ready() <-chan Signal
 	Done() <-chan Signal
 	Parents() []Node
@@ -24,14 +54,208 @@ type Node interface {
 
 	AddChild(Node) error
 	AddParent(Node) error
-	Activate()
-	Execute() error
+	Activate(context.Context)
+	Execute(context.Context) error
 }
 
-// Condition represents a conditional statement.
-type Condition func() bool
+// Condition represents a conditional statement. It is evaluated against a snapshot of the fleet
+// and workflow variables taken when a Conditional executes.
+type Condition func(Snapshot) bool
 
 // TruthyCondition always returns true.
-var TruthyCondition = func() bool {
+var TruthyCondition = func(Snapshot) bool {
 	return true
 }
+
+// Attempt records one try at executing a node.
+type Attempt struct {
+	Start time.Time
+	End   time.Time
+	Err   error
+}
+
+// nodeState guards the execution state of a node. It has its own lock because a node holds its
+// mutex for as long as it waits on dependencies, and state must remain readable meanwhile.
+type nodeState struct {
+	mutex    sync.RWMutex
+	state    State
+	start    time.Time
+	end      time.Time
+	attempts []Attempt
+	err      error
+	robot    string
+
+	// checkpoint is what the run that is being resumed recorded about the node.
+	checkpoint *NodeCheckpoint
+}
+
+func newNodeState() *nodeState {
+	return &nodeState{state: StatePending}
+}
+
+func (s *nodeState) get() State {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.state
+}
+
+// set moves a node to another state, and keeps track of when it started and finished executing.
+func (s *nodeState) set(state State) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.transition(state)
+}
+
+func (s *nodeState) transition(state State) {
+	s.state = state
+	switch state {
+	case StateRunning:
+		s.start = time.Now()
+	case StateSucceeded, StateFailed, StateSkipped, StateCancelled:
+		s.end = time.Now()
+		if s.start.IsZero() {
+			s.start = s.end
+		}
+	}
+}
+
+// fail moves a node to the failed state and records the reason.
+func (s *nodeState) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err
+	s.transition(StateFailed)
+}
+
+// restore remembers what a previous run recorded about the node.
+func (s *nodeState) restore(cp *NodeCheckpoint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.checkpoint = cp
+}
+
+// restored returns what a previous run recorded about the node, or nil.
+func (s *nodeState) restored() *NodeCheckpoint {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.checkpoint
+}
+
+// completed reports whether the node succeeded before its run was resumed.
+func (s *nodeState) completed() bool {
+	cp := s.restored()
+	return cp != nil && cp.State == StateSucceeded
+}
+
+// setRobot records the robot that a node sent on a mission.
+func (s *nodeState) setRobot(robot string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.robot = robot
+}
+
+func (s *nodeState) addAttempt(attempt Attempt) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.attempts = append(s.attempts, attempt)
+}
+
+func (s *nodeState) getAttempts() []Attempt {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	attempts := make([]Attempt, len(s.attempts))
+	copy(attempts, s.attempts)
+	return attempts
+}
+
+// cancel moves a node that has not finished yet to the cancelled state.
+func (s *nodeState) cancel() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case StatePending, StateReady, StateRunning:
+		s.transition(StateCancelled)
+	}
+}
+
+// result returns a copy of everything recorded about the execution of n.
+func (s *nodeState) result(n Node) *NodeResult {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	attempts := make([]Attempt, len(s.attempts))
+	copy(attempts, s.attempts)
+
+	return &NodeResult{
+		ID:       n.ID(),
+		Name:     n.Name(),
+		State:    s.state,
+		Start:    s.start,
+		End:      s.end,
+		Attempts: attempts,
+		Err:      s.err,
+		Robot:    s.robot,
+	}
+}
+
+// stateOf returns the state holder of any node type in this package.
+func stateOf(n Node) *nodeState {
+	switch n := n.(type) {
+	case *Root:
+		return n.state
+	case *Job:
+		return n.state
+	case *Conditional:
+		return n.state
+	case *Terminal:
+		return n.state
+	default:
+		return newNodeState()
+	}
+}
+
+// awaitDependencies blocks until every parent of node id is done and merges their signals into the
+// node's ready signal. A node is skipped only when all of its parents were skipped, or did not
+// take the branch that leads to it, so that a node joining both branches of a Conditional still
+// executes. A single failed parent, however, is enough to fail the ready signal. It returns false
+// when the context is cancelled before every dependency is met.
+func awaitDependencies(ctx context.Context, id uuid.UUID, parents map[uuid.UUID]Node) (Signal, bool) {
+	mux := make(chan Signal, len(parents))
+	for _, dep := range parents {
+		go func(dep Node, mux chan<- Signal) {
+			select {
+			case <-ctx.Done():
+			case sig := <-dep.Done():
+				if c, ok := dep.(*Conditional); ok && !c.takes(id) {
+					sig.Skip = true
+				}
+
+				mux <- sig
+			}
+		}(dep, mux)
+	}
+
+	ready := Signal{ID: id, Pass: true, Skip: len(parents) > 0}
+	met := make(map[uuid.UUID]struct{})
+	for len(met) < len(parents) {
+		select {
+		case <-ctx.Done():
+			return ready, false
+		case sig := <-mux:
+			met[sig.ID] = struct{}{}
+			ready.Skip = ready.Skip && sig.Skip
+			ready.Pass = ready.Pass && sig.Pass
+		}
+	}
+
+	return ready, true
+}
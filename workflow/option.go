@@ -0,0 +1,208 @@
+package workflow
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// FailurePolicy decides what happens to the rest of a run when a node fails.
+type FailurePolicy string
+
+// Failure policies a node can be configured with.
+const (
+	// FailFast aborts the whole run.
+	FailFast FailurePolicy = "fail_fast"
+
+	// SkipDescendants skips every node downstream of the failed node, and lets the rest of the
+	// graph carry on.
+	SkipDescendants FailurePolicy = "skip_descendants"
+
+	// ContinueAnyway treats the failure as if the node had succeeded.
+	ContinueAnyway FailurePolicy = "continue"
+)
+
+func (p FailurePolicy) validate() error {
+	switch p {
+	case FailFast, SkipDescendants, ContinueAnyway:
+		return nil
+	default:
+		return fmt.Errorf("has unknown failure policy %q", p)
+	}
+}
+
+// OfflinePolicy decides what a job does when its robot goes offline in the middle of a mission.
+type OfflinePolicy string
+
+// Offline policies a job can be configured with.
+const (
+	// FailOffline fails the attempt, which may be retried.
+	FailOffline OfflinePolicy = "fail"
+
+	// PauseOffline waits for the robot to come back, and carries on with the mission from there.
+	PauseOffline OfflinePolicy = "pause"
+)
+
+func (p OfflinePolicy) validate() error {
+	switch p {
+	case FailOffline, PauseOffline:
+		return nil
+	default:
+		return fmt.Errorf("has unknown offline policy %q", p)
+	}
+}
+
+// Retry describes how many times a node is attempted before it is considered failed, and how long
+// to wait in between. The wait starts at Backoff and doubles after every failed attempt up to
+// MaxBackoff, plus a random duration of up to Jitter.
+type Retry struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+	Jitter      time.Duration `yaml:"jitter"`
+}
+
+// DefaultMaxBackoff caps the wait between attempts when a retry policy does not set MaxBackoff.
+const DefaultMaxBackoff = 5 * time.Minute
+
+func (r Retry) validate() error {
+	switch {
+	case r.MaxAttempts < 0:
+		return fmt.Errorf("has a negative number of attempts %d", r.MaxAttempts)
+	case r.Backoff < 0:
+		return fmt.Errorf("has a negative backoff %v", r.Backoff)
+	case r.MaxBackoff < 0:
+		return fmt.Errorf("has a negative max backoff %v", r.MaxBackoff)
+	case r.Jitter < 0:
+		return fmt.Errorf("has a negative jitter %v", r.Jitter)
+	default:
+		return nil
+	}
+}
+
+// delay returns how long to wait before the given attempt, counting from 1.
+func (r Retry) delay(attempt int) time.Duration {
+	max := r.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	d := r.Backoff
+	for i := 2; i < attempt && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	if r.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(r.Jitter) + 1))
+	}
+
+	return d
+}
+
+// Option configures optional behavior of a node.
+type Option func(*options)
+
+type options struct {
+	onFailure FailurePolicy
+	timeout   *time.Duration
+	retry     *Retry
+	onOffline OfflinePolicy
+
+	requirement *Requirement
+}
+
+// attemptTimeout returns how long a single attempt may take, falling back to job.timeout from the
+// config. Zero means an attempt may take forever.
+func (o options) attemptTimeout() time.Duration {
+	if o.timeout != nil {
+		return *o.timeout
+	}
+
+	return viper.GetDuration("job.timeout")
+}
+
+// retryPolicy returns the retry policy, falling back to the job section of the config.
+func (o options) retryPolicy() Retry {
+	r := Retry{
+		MaxAttempts: viper.GetInt("job.max_attempts"),
+		Backoff:     viper.GetDuration("job.backoff"),
+		MaxBackoff:  viper.GetDuration("job.max_backoff"),
+		Jitter:      viper.GetDuration("job.jitter"),
+	}
+
+	if o.retry != nil {
+		r = *o.retry
+	}
+
+	if r.MaxAttempts < 1 {
+		r.MaxAttempts = 1
+	}
+
+	return r
+}
+
+// offlinePolicy returns the offline policy, falling back to job.on_offline from the config. Jobs
+// fail when neither is set. An unknown policy, such as a typo in the config, is reported by Validate
+// so that a run does not start with it.
+func (o options) offlinePolicy() (OfflinePolicy, error) {
+	if o.onOffline != "" {
+		return o.onOffline, o.onOffline.validate()
+	}
+
+	p := OfflinePolicy(viper.GetString("job.on_offline"))
+	if p == "" {
+		return FailOffline, nil
+	}
+
+	if err := p.validate(); err != nil {
+		return "", fmt.Errorf("%v in job.on_offline", err)
+	}
+
+	return p, nil
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		onFailure: SkipDescendants,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// OnFailure sets the failure policy of a node. Nodes skip their descendants by default.
+func OnFailure(policy FailurePolicy) Option {
+	return func(o *options) {
+		o.onFailure = policy
+	}
+}
+
+// WithTimeout limits how long every attempt at executing a node may take.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = &timeout
+	}
+}
+
+// WithRetry attempts a node again when it fails, as described by retry.
+func WithRetry(retry Retry) Option {
+	return func(o *options) {
+		o.retry = &retry
+	}
+}
+
+// OnOffline sets what a job does when its robot goes offline in the middle of a mission.
+func OnOffline(policy OfflinePolicy) Option {
+	return func(o *options) {
+		o.onOffline = policy
+	}
+}
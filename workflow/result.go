@@ -0,0 +1,123 @@
+package workflow
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// NodeResult records how a single node fared during a run.
+type NodeResult struct {
+	ID    uuid.UUID
+	Name  string
+	State State
+
+	// Start and End are zero when the node never started or never finished.
+	Start time.Time
+	End   time.Time
+
+	Attempts []Attempt
+	Err      error
+
+	// Robot is the robot a job sent on a mission, it is empty for every other node.
+	Robot string
+}
+
+// Duration returns how long the node took to execute.
+func (r *NodeResult) Duration() time.Duration {
+	if r.Start.IsZero() || r.End.IsZero() {
+		return 0
+	}
+
+	return r.End.Sub(r.Start)
+}
+
+// RunResult is the timeline of a run, with one entry per node ordered by start time. Nodes that
+// never started are listed last, by name.
+type RunResult struct {
+	Start time.Time
+	End   time.Time
+	Nodes []*NodeResult
+}
+
+// Get returns the result of n, or nil when n was not part of the run.
+func (r *RunResult) Get(n Node) *NodeResult {
+	for _, res := range r.Nodes {
+		if res.ID == n.ID() {
+			return res
+		}
+	}
+
+	return nil
+}
+
+// Find returns the results of every node with the given name.
+func (r *RunResult) Find(name string) []*NodeResult {
+	found := []*NodeResult{}
+	for _, res := range r.Nodes {
+		if res.Name == name {
+			found = append(found, res)
+		}
+	}
+
+	return found
+}
+
+// Count returns the number of nodes that ended up in state.
+func (r *RunResult) Count(state State) int {
+	count := 0
+	for _, res := range r.Nodes {
+		if res.State == state {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (r *RunResult) String() string {
+	s := fmt.Sprintf("run took %s", r.End.Sub(r.Start))
+	for _, res := range r.Nodes {
+		s += fmt.Sprintf("\n  %-10s %q", res.State, res.Name)
+		if !res.Start.IsZero() {
+			s += fmt.Sprintf(" at +%s for %s", res.Start.Sub(r.Start), res.Duration())
+		}
+
+		if res.Robot != "" {
+			s += fmt.Sprintf(" with %s", res.Robot)
+		}
+
+		if len(res.Attempts) > 1 {
+			s += fmt.Sprintf(" after %d attempts", len(res.Attempts))
+		}
+
+		if res.Err != nil {
+			s += fmt.Sprintf(": %v", res.Err)
+		}
+	}
+
+	return s
+}
+
+// newRunResult gathers the results of every node connected to root.
+func newRunResult(root Node, start time.Time) *RunResult {
+	nodes := collect(root)
+	result := &RunResult{Start: start, End: time.Now(), Nodes: make([]*NodeResult, 0, len(nodes))}
+	for _, n := range nodes {
+		result.Nodes = append(result.Nodes, stateOf(n).result(n))
+	}
+
+	// collect sorts nodes by name, which keeps the order stable for nodes that started together.
+	sort.SliceStable(result.Nodes, func(i, j int) bool {
+		a, b := result.Nodes[i].Start, result.Nodes[j].Start
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero() && b.IsZero()
+		}
+
+		return a.Before(b)
+	})
+
+	return result
+}
@@ -1,6 +1,7 @@
 package workflow
 
 import (
+	"context"
 	"errors"
 	"sync"
 
@@ -14,10 +15,12 @@ func NewRoot(name string) Node {
 		name:      name,
 		activated: false,
 		mutex:     &sync.Mutex{},
+		state:     newNodeState(),
 		ready:     make(chan Signal, 1),
 		done:      make(chan Signal, MaxNumDep),
 		parents:   make(map[uuid.UUID]Node),
 		children:  make(map[uuid.UUID]Node),
+		variables: make(map[string]string),
 	}
 
 	return r
@@ -29,6 +32,7 @@ type Root struct {
 	name      string
 	activated bool
 	mutex     *sync.Mutex
+	state     *nodeState
 
 	// Means to communicate with other nodes
 	ready chan Signal
@@ -36,6 +40,8 @@ type Root struct {
 
 	parents  map[uuid.UUID]Node
 	children map[uuid.UUID]Node
+
+	variables map[string]string
 }
 
 // ID returns Node's unique identifier.
@@ -48,6 +54,11 @@ func (r *Root) Name() string {
 	return r.name
 }
 
+// State returns Node's execution state.
+func (r *Root) State() State {
+	return r.state.get()
+}
+
 // Ready returns a channel that emits ready signal.
 func (r *Root) Ready() <-chan Signal {
 	return r.ready
@@ -101,16 +112,17 @@ func (r *Root) AddChild(n Node) error {
 }
 
 // Activate turns a node on and actively checks whether dependencies are met.
-func (r *Root) Activate() {
+func (r *Root) Activate(ctx context.Context) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
 	r.activated = true
+	r.state.set(StateReady)
 	r.ready <- Signal{ID: r.id, Pass: true}
 }
 
 // Execute performs an action.
-func (r *Root) Execute() error {
+func (r *Root) Execute(ctx context.Context) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
@@ -118,9 +130,45 @@ func (r *Root) Execute() error {
 		return errors.New("must activate a node before execution")
 	}
 
+	r.state.set(StateSucceeded)
+
 	for i := 0; i < len(r.children); i++ {
 		r.done <- Signal{ID: r.id, Pass: true}
 	}
 
 	return nil
 }
+
+// SetVariable assigns a workflow variable that conditions can inspect through their snapshot.
+func (r *Root) SetVariable(name, value string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.variables[name] = value
+}
+
+// Variables returns a copy of the workflow variables.
+func (r *Root) Variables() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	variables := make(map[string]string, len(r.variables))
+	for name, value := range r.variables {
+		variables[name] = value
+	}
+
+	return variables
+}
+
+// variablesOf returns the workflow variables of the graph that n belongs to.
+func variablesOf(n Node) map[string]string {
+	for len(n.Parents()) > 0 {
+		n = n.Parents()[0]
+	}
+
+	if r, ok := n.(*Root); ok {
+		return r.Variables()
+	}
+
+	return make(map[string]string)
+}
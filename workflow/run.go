@@ -1,25 +1,193 @@
 package workflow
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 )
 
-// Run starts an executation graph.
-func Run(root Node) error {
+// NodeError is the error returned by a node that failed during a run. The failure is not fatal
+// when the node is configured to continue anyway.
+type NodeError struct {
+	Node  Node
+	Err   error
+	Fatal bool
+}
+
+// RunError summarizes a run in which nodes failed. Nodes that failed but continued anyway are
+// listed too, see Fatal.
+type RunError struct {
+	Failed []NodeError
+
+	// Skipped maps every node that was skipped because of a failure to the failed nodes upstream.
+	Skipped map[Node][]Node
+
+	// Aborted is set when a node with the FailFast policy stopped the run early.
+	Aborted bool
+}
+
+func (e *RunError) Error() string {
+	msgs := make([]string, 0, len(e.Failed)+len(e.Skipped))
+	for _, f := range e.Failed {
+		if f.Fatal {
+			msgs = append(msgs, fmt.Sprintf("node %q failed: %v", f.Node.Name(), f.Err))
+		} else {
+			msgs = append(msgs, fmt.Sprintf("node %q failed and continued anyway: %v", f.Node.Name(), f.Err))
+		}
+	}
+
+	skipped := make([]Node, 0, len(e.Skipped))
+	for n := range e.Skipped {
+		skipped = append(skipped, n)
+	}
+
+	for _, n := range sorted(skipped) {
+		causes := make([]string, 0, len(e.Skipped[n]))
+		for _, cause := range sorted(e.Skipped[n]) {
+			causes = append(causes, fmt.Sprintf("%q", cause.Name()))
+		}
+
+		msgs = append(msgs, fmt.Sprintf("node %q skipped because of %s", n.Name(), strings.Join(causes, ", ")))
+	}
+
+	if e.Aborted {
+		return fmt.Sprintf("run aborted: %s", strings.Join(msgs, "; "))
+	}
+
+	if !e.Fatal() {
+		return fmt.Sprintf("run completed despite failures: %s", strings.Join(msgs, "; "))
+	}
+
+	return fmt.Sprintf("run failed: %s", strings.Join(msgs, "; "))
+}
+
+// Fatal reports whether the run failed, as opposed to only having nodes that failed and continued
+// anyway.
+func (e *RunError) Fatal() bool {
+	if e.Aborted {
+		return true
+	}
+
+	for _, f := range e.Failed {
+		if f.Fatal {
+			return true
+		}
+	}
+
+	return false
+}
+
+type runIDKey struct{}
+
+// WithRunID returns a copy of ctx that carries the ID of a run, which identifies the run as the
+// owner of the robots its jobs lease.
+func WithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// RunID returns the ID of the run carried by ctx, or an empty string.
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
+
+type execution struct {
+	node Node
+	err  error
+}
+
+// Run starts an executation graph and returns the timeline of every node. It returns a *RunError
+// when any node fails, which is not fatal when every node that failed is configured to continue
+// anyway. The result is nil only when the graph is refused before it starts. Every listener is
+// told about each step of the run.
+func Run(root Node, ls ...EventListener) (*RunResult, error) {
+	return RunContext(context.Background(), root, ls...)
+}
+
+// RunContext is like Run, but stops dispatching nodes once ctx is done. Nodes that are executing
+// are told to stop, and every node that has not finished is marked as cancelled before the
+// context's error is returned along with the partial result. States of nodes that did finish are
+// left as they are.
+func RunContext(ctx context.Context, root Node, ls ...EventListener) (*RunResult, error) {
+	notify := listeners(ls)
 	if len(root.Parents()) != 0 {
-		return errors.New("root node cannot have any dependency")
+		return notify.finished(nil, errors.New("root node cannot have any dependency"))
+	}
+
+	if errs := Validate(root); len(errs) > 0 {
+		return notify.finished(nil, ValidationErrors(errs))
+	}
+
+	start := time.Now()
+
+	// Aborting a run cancels this context, which stops every node that is waiting or executing.
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runErr := &RunError{Skipped: make(map[Node][]Node)}
+	executions := make(chan execution, MaxNumDep)
+	running := 0
+
+	abort := func() {
+		cancel()
+		for ; running > 0; running-- {
+			notify.executed(<-executions)
+		}
+
+		for _, n := range collect(root) {
+			stateOf(n).cancel()
+		}
+		notify.cancelled(root)
 	}
 
 	queue := NewActiveQueue()
-	queue.add(root)
-	for len(queue.set) > 0 {
-		node := queue.next()
+	queue.add(ctx, root)
+	for len(queue.set) > 0 || running > 0 {
+		var node Node
+		select {
+		case <-ctx.Done():
+			abort()
+			return notify.finished(newRunResult(root, start), parent.Err())
+		case ex := <-executions:
+			running--
+			notify.executed(ex)
+			if ex.err == nil || ctx.Err() != nil {
+				continue
+			}
+
+			fatal := failurePolicy(ex.node) != ContinueAnyway
+			runErr.Failed = append(runErr.Failed, NodeError{Node: ex.node, Err: ex.err, Fatal: fatal})
+			if !fatal {
+				continue
+			}
+
+			if failurePolicy(ex.node) == FailFast {
+				runErr.Aborted = true
+				abort()
+				return notify.finished(newRunResult(root, start), runErr)
+			}
+
+			continue
+		case sig := <-queue.mux:
+			node = queue.remove(sig)
+			if !sig.Pass {
+				runErr.Skipped[node] = failedAncestors(node)
+			}
+			notify.ready(node)
+		}
 
 		// Conditional and Terminal nodes are executed synchronously.
+		running++
+		notify.started(node)
 		if len(node.Children()) == 0 || node.IsConditional() {
-			node.Execute()
+			executions <- execution{node: node, err: node.Execute(ctx)}
 		} else {
-			go node.Execute()
+			go func(node Node) {
+				executions <- execution{node: node, err: node.Execute(ctx)}
+			}(node)
 		}
 
 		for _, child := range node.Children() {
@@ -27,9 +195,46 @@ func Run(root Node) error {
 				continue
 			}
 
-			queue.add(child)
+			queue.add(ctx, child)
+		}
+	}
+
+	result := newRunResult(root, start)
+	if len(runErr.Failed) > 0 {
+		return notify.finished(result, runErr)
+	}
+
+	return notify.finished(result, nil)
+}
+
+func failurePolicy(n Node) FailurePolicy {
+	if j, ok := n.(*Job); ok {
+		return j.options.onFailure
+	}
+
+	return SkipDescendants
+}
+
+// failedAncestors returns every node upstream of n that failed.
+func failedAncestors(n Node) []Node {
+	failed := []Node{}
+	seen := make(map[Node]bool)
+
+	var visit func(n Node)
+	visit = func(n Node) {
+		for _, p := range n.Parents() {
+			if seen[p] {
+				continue
+			}
+
+			seen[p] = true
+			if p.State() == StateFailed {
+				failed = append(failed, p)
+			}
+			visit(p)
 		}
 	}
+	visit(n)
 
-	return nil
+	return failed
 }
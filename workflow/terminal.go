@@ -1,6 +1,7 @@
 package workflow
 
 import (
+	"context"
 	"errors"
 	"sync"
 
@@ -15,6 +16,7 @@ func NewTerminal(dependencies []Node, name string) Node {
 		name:      name,
 		activated: false,
 		mutex:     &sync.Mutex{},
+		state:     newNodeState(),
 		ready:     make(chan Signal, 1),
 		done:      make(chan Signal, 1),
 		parents:   make(map[uuid.UUID]Node),
@@ -35,10 +37,12 @@ type Terminal struct {
 	name      string
 	activated bool
 	mutex     *sync.Mutex
+	state     *nodeState
 
 	// Means to communicate with other nodes
-	ready chan Signal
-	done  chan Signal
+	ready      chan Signal
+	done       chan Signal
+	activation Signal
 
 	parents  map[uuid.UUID]Node
 	children map[uuid.UUID]Node
@@ -54,6 +58,11 @@ func (t *Terminal) Name() string {
 	return t.name
 }
 
+// State returns Node's execution state.
+func (t *Terminal) State() State {
+	return t.state.get()
+}
+
 // Ready returns a channel that emits ready signal.
 func (t *Terminal) Ready() <-chan Signal {
 	return t.ready
@@ -103,31 +112,29 @@ func (t *Terminal) IsConditional() bool {
 }
 
 // Activate turns a node on and actively checks whether dependencies are met.
-func (t *Terminal) Activate() {
+func (t *Terminal) Activate(ctx context.Context) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	mux := make(chan Signal, len(t.parents))
-	met := make(map[uuid.UUID]struct{})
-	for _, dep := range t.parents {
-		go func(id uuid.UUID, mux chan<- Signal, done <-chan Signal) {
-			mux <- <-done
-		}(dep.ID(), mux, dep.Done())
+	sig, ok := awaitDependencies(ctx, t.id, t.parents)
+	if !ok {
+		t.state.cancel()
+		return
 	}
 
-	for sig := range mux {
-		met[sig.ID] = struct{}{}
-
-		if len(met) == len(t.parents) {
-			t.activated = true
-			t.ready <- Signal{ID: t.id, Pass: true}
-			return
-		}
+	t.activated = true
+	t.activation = sig
+	if sig.skipped() {
+		t.state.set(StateSkipped)
+	} else {
+		t.state.set(StateReady)
 	}
+
+	t.ready <- sig
 }
 
 // Execute performs an action.
-func (t *Terminal) Execute() error {
+func (t *Terminal) Execute(ctx context.Context) error {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
@@ -135,7 +142,14 @@ func (t *Terminal) Execute() error {
 		return errors.New("must activate a node before execution")
 	}
 
+	if t.state.get() == StateSkipped {
+		log.Infof("terminal node %s is skipped", t.name)
+		t.done <- Signal{ID: t.id, Pass: t.activation.Pass, Skip: true}
+		return nil
+	}
+
 	log.Infof("terminal node %s is reached", t.name)
+	t.state.set(StateSucceeded)
 
 	t.done <- Signal{ID: t.id, Pass: true}
 
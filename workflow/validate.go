@@ -0,0 +1,280 @@
+package workflow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ValidationError describes a structural problem of an execution graph.
+type ValidationError struct {
+	ID   uuid.UUID
+	Node string
+	Msg  string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("node %q %s", e.Node, e.Msg)
+}
+
+// ValidationErrors is returned by Run when it refuses to execute an invalid graph.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Sprintf("invalid execution graph: %s", strings.Join(msgs, "; "))
+}
+
+// Validate walks every node connected to root, through both parents and children, and reports
+// problems that would otherwise only show up at runtime, usually as a graph that never finishes.
+// An empty result means the graph is safe to run.
+func Validate(root Node) []ValidationError {
+	errs := []ValidationError{}
+	report := func(n Node, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{ID: n.ID(), Node: n.Name(), Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if len(root.Parents()) != 0 {
+		report(root, "is used as root but has dependencies")
+	}
+
+	nodes := collect(root)
+	reported := make(map[uuid.UUID]bool)
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *Root:
+			if n != root {
+				report(n, "is a second root, graph already starts at %q", root.Name())
+				reported[n.ID()] = true
+			}
+		case *Job:
+			switch req := n.options.requirement; {
+			case n.device == "" && req == nil:
+				report(n, "is a job without a device")
+			case n.device != "" && req != nil:
+				report(n, "is a job with both a device and a robot requirement")
+			case req != nil:
+				if err := req.validate(); err != nil {
+					report(n, "%s", err)
+				} else if req.SameAs != "" && !sameAsUpstream(n, req.SameAs) {
+					report(n, "requires the robot of %q, which is not a job upstream", req.SameAs)
+				}
+			}
+
+			if err := n.action.validate(); err != nil {
+				report(n, "%s", err)
+			}
+
+			if err := n.options.onFailure.validate(); err != nil {
+				report(n, "%s", err)
+			}
+
+			if _, err := n.options.offlinePolicy(); err != nil {
+				report(n, "%s", err)
+			}
+		}
+
+		if n != root && len(n.Parents()) == 0 {
+			if _, ok := n.(*Root); !ok {
+				report(n, "is an orphan, it does not depend on any node")
+				reported[n.ID()] = true
+			}
+		}
+
+		if _, ok := n.(*Terminal); !ok && len(n.Children()) == 0 {
+			report(n, "is dangling, no node depends on it")
+		}
+
+		for _, p := range n.Parents() {
+			if !contains(p.Children(), n) {
+				if len(p.Children()) >= MaxNumDep {
+					report(n, "can never become ready, %q already has the maximum of %d children", p.Name(), MaxNumDep)
+				} else {
+					report(n, "can never become ready, %q does not list it as a child", p.Name())
+				}
+				reported[n.ID()] = true
+			}
+		}
+	}
+
+	for _, cycle := range cycles(nodes) {
+		names := make([]string, 0, len(cycle)+1)
+		for _, n := range cycle {
+			names = append(names, fmt.Sprintf("%q", n.Name()))
+			reported[n.ID()] = true
+		}
+		names = append(names, fmt.Sprintf("%q", cycle[0].Name()))
+
+		report(cycle[0], "is part of a cycle %s", strings.Join(names, " -> "))
+	}
+
+	reachable := make(map[uuid.UUID]bool)
+	var visit func(n Node)
+	visit = func(n Node) {
+		if reachable[n.ID()] {
+			return
+		}
+
+		reachable[n.ID()] = true
+		for _, c := range n.Children() {
+			visit(c)
+		}
+	}
+	visit(root)
+
+	for _, n := range nodes {
+		if !reachable[n.ID()] && !reported[n.ID()] {
+			report(n, "is unreachable from root %q", root.Name())
+			reported[n.ID()] = true
+		}
+	}
+
+	// A node becomes ready once every parent has become ready and executed. Whatever is left once
+	// no more progress can be made is waiting on a node that was already reported above.
+	ready := map[uuid.UUID]bool{root.ID(): true}
+	for progress := true; progress; {
+		progress = false
+		for _, n := range nodes {
+			if ready[n.ID()] || reported[n.ID()] || len(n.Parents()) == 0 {
+				continue
+			}
+
+			met := true
+			for _, p := range n.Parents() {
+				met = met && ready[p.ID()]
+			}
+
+			if met {
+				ready[n.ID()] = true
+				progress = true
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		if ready[n.ID()] || reported[n.ID()] {
+			continue
+		}
+
+		for _, p := range sorted(n.Parents()) {
+			if !ready[p.ID()] {
+				report(n, "can never become ready, it waits on %q", p.Name())
+				break
+			}
+		}
+	}
+
+	return errs
+}
+
+// collect returns every node connected to n, sorted by name so that results are deterministic.
+func collect(n Node) []Node {
+	seen := make(map[uuid.UUID]Node)
+	var visit func(n Node)
+	visit = func(n Node) {
+		if _, ok := seen[n.ID()]; ok {
+			return
+		}
+
+		seen[n.ID()] = n
+		for _, p := range n.Parents() {
+			visit(p)
+		}
+
+		for _, c := range n.Children() {
+			visit(c)
+		}
+	}
+	visit(n)
+
+	nodes := make([]Node, 0, len(seen))
+	for _, n := range seen {
+		nodes = append(nodes, n)
+	}
+
+	return sorted(nodes)
+}
+
+// cycles returns one path for every cycle found by a depth-first search over children.
+func cycles(nodes []Node) [][]Node {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	result := [][]Node{}
+	state := make(map[uuid.UUID]int)
+	stack := []Node{}
+
+	var visit func(n Node)
+	visit = func(n Node) {
+		state[n.ID()] = visiting
+		stack = append(stack, n)
+
+		for _, c := range sorted(n.Children()) {
+			switch state[c.ID()] {
+			case unvisited:
+				visit(c)
+			case visiting:
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == c {
+						cycle := make([]Node, len(stack)-i)
+						copy(cycle, stack[i:])
+						result = append(result, cycle)
+						break
+					}
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[n.ID()] = visited
+	}
+
+	for _, n := range nodes {
+		if state[n.ID()] == unvisited {
+			visit(n)
+		}
+	}
+
+	return result
+}
+
+func contains(nodes []Node, n Node) bool {
+	for _, node := range nodes {
+		if node.ID() == n.ID() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sorted(nodes []Node) []Node {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Name() == nodes[j].Name() {
+			return nodes[i].ID().String() < nodes[j].ID().String()
+		}
+
+		return nodes[i].Name() < nodes[j].Name()
+	})
+
+	return nodes
+}
+
+func sameAsUpstream(j *Job, name string) bool {
+	for _, up := range upstreamJobs(j) {
+		if up.name == name {
+			return true
+		}
+	}
+
+	return false
+}